@@ -0,0 +1,89 @@
+package stampede
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is the error of fetches which were short-circuited by an
+// open circuit breaker, see WithCircuitBreaker. It's wrapped in a *StaleError
+// when a stale value is served instead, see WithStaleIfError.
+var ErrCircuitOpen = errors.New("stampede: circuit breaker is open")
+
+// circuitBreakers holds the circuit breakers of the key groups of a stampede
+// instance. Only groups with failed fetches are tracked.
+type circuitBreakers struct {
+	mu sync.Mutex
+	m  map[string]*circuit
+}
+
+// circuit is the circuit breaker of a key group. It's closed until threshold
+// consecutive fetches have failed, then it's open and short-circuits fetches
+// for the cooldown. It's half-open once the cooldown has passed, letting a
+// single probing fetch through, which closes it on success or opens it again
+// on failure.
+type circuit struct {
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+// allow reports whether a fetch of group may run. If so, its outcome must be
+// recorded with done.
+func (b *circuitBreakers) allow(group string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c, ok := b.m[group]
+	if !ok || c.openUntil.IsZero() {
+		return true
+	}
+	if time.Now().Before(c.openUntil) || c.probing {
+		return false
+	}
+	c.probing = true
+	return true
+}
+
+// done records the outcome of a fetch of group.
+func (b *circuitBreakers) done(group string, err error, threshold int, cooldown time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil {
+		delete(b.m, group)
+		return
+	}
+	c, ok := b.m[group]
+	if errors.Is(err, ErrNotFound) || errors.Is(err, context.Canceled) {
+		// not a failure of the upstream, ie. all callers have gone away,
+		// so another fetch may probe it.
+		if ok {
+			c.probing = false
+		}
+		return
+	}
+	if !ok {
+		if b.m == nil {
+			b.m = make(map[string]*circuit)
+		}
+		c = &circuit{}
+		b.m[group] = c
+	}
+	c.failures++
+	if c.probing || c.failures >= threshold {
+		c.probing = false
+		if cooldown <= 0 {
+			cooldown = DefaultCircuitBreakerCooldown
+		}
+		c.openUntil = time.Now().Add(cooldown)
+	}
+}
+
+// circuitGroup returns the circuit breaker group of key.
+func (s *Stampede[V]) circuitGroup(key string) string {
+	if s.opts().CircuitBreakerGroup == nil {
+		return ""
+	}
+	return s.opts().CircuitBreakerGroup(key)
+}
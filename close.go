@@ -0,0 +1,112 @@
+package stampede
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+)
+
+// ErrClosed is the error of calls to a stampede instance which was closed.
+var ErrClosed = errors.New("stampede: closed")
+
+// Closer is implemented by Stampede and HTTPHandler, see Shutdown.
+type Closer interface {
+	Close(ctx context.Context) error
+}
+
+var (
+	_ Closer = &Stampede[any]{}
+	_ Closer = &HTTPHandler{}
+)
+
+// Close closes the stampede instance. New calls are rejected with ErrClosed,
+// the refresh-ahead of registered keys is stopped, and Close waits for the
+// fetches in progress to complete and their values to be written to the
+// cache, including the pending writes of the write-behind queue, until ctx
+// is done. Fetches which were requested but haven't started yet fail with
+// ErrClosed.
+func (s *Stampede[V]) Close(ctx context.Context) error {
+	idle := s.lifecycle.close()
+	refreshed := s.closeRefresher()
+	for _, done := range []<-chan struct{}{refreshed, idle} {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	// no more fetches are running, so the write-behind queue may be flushed
+	select {
+	case <-s.closeWrites():
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return nil
+}
+
+// Shutdown gracefully shuts down srv with srv.Shutdown, which waits for the
+// requests in progress, and then closes the stampede handlers and instances
+// used by srv, which waits for their background fetches and cache writes,
+// until ctx is done.
+func Shutdown(ctx context.Context, srv *http.Server, closers ...Closer) error {
+	err := srv.Shutdown(ctx)
+	for _, c := range closers {
+		err = errors.Join(err, c.Close(ctx))
+	}
+	return err
+}
+
+// lifecycle tracks the work in progress of a stampede instance, ie. its
+// fetches, so closing it may wait for the work to complete.
+type lifecycle struct {
+	mu     sync.Mutex
+	closed bool
+	n      int
+	idle   chan struct{}
+}
+
+// isClosed reports whether the stampede instance was closed.
+func (l *lifecycle) isClosed() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.closed
+}
+
+// add tracks a new piece of work, which must be marked done. It returns
+// false once closed, where the work must not be started.
+func (l *lifecycle) add() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return false
+	}
+	l.n++
+	return true
+}
+
+func (l *lifecycle) done() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.n--
+	if l.n == 0 && l.idle != nil {
+		close(l.idle)
+		l.idle = nil
+	}
+}
+
+// close rejects any new work, and returns a channel which is closed once the
+// work in progress is done.
+func (l *lifecycle) close() <-chan struct{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closed = true
+	if l.idle == nil {
+		l.idle = make(chan struct{})
+		if l.n == 0 {
+			close(l.idle)
+		}
+	}
+	return l.idle
+}
@@ -0,0 +1,314 @@
+package stampede
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"math/rand/v2"
+	"strings"
+	"sync"
+	"time"
+
+	cachestore "github.com/goware/cachestore2"
+)
+
+// entry is the envelope of a value in the cache store, which carries the
+// freshness metadata of the value along with it, so every process sharing
+// the cache store, or restarted in the meantime, knows when the value turns
+// stale. The hard expiry of the value is the TTL of the key in the cache
+// store.
+type entry[V any] struct {
+	Value V `json:"value"`
+
+	// CreatedAt is when the value was fetched.
+	CreatedAt time.Time `json:"createdAt"`
+
+	// FreshUntil is the soft expiry of the value. After this point the
+	// value is considered stale, but may still be served.
+	FreshUntil time.Time `json:"freshUntil"`
+
+	// Delta is how long it took to fetch the value.
+	Delta time.Duration `json:"delta"`
+}
+
+// getEntry reads the envelope of key from the cache store. A value which
+// isn't an envelope, ie. written by an older version of stampede sharing the
+// cache backend, is treated as a miss rather than an error.
+func (s *Stampede[V]) getEntry(ctx context.Context, key string) (entry[V], bool, error) {
+	e, ok, err := s.cache.Get(ctx, key)
+	if isDecodeError(err) {
+		return entry[V]{}, false, nil
+	}
+	if err != nil || !ok || e.CreatedAt.IsZero() {
+		return entry[V]{}, false, err
+	}
+	return e, true, nil
+}
+
+// batchGetEntries is like getEntry, for several keys at once.
+func (s *Stampede[V]) batchGetEntries(ctx context.Context, keys []string) ([]entry[V], []bool, error) {
+	es, oks, err := s.cache.BatchGet(ctx, keys)
+	if isDecodeError(err) {
+		// the batch fails as a whole, so the keys are read one by one to
+		// tell the values which aren't envelopes apart
+		es, oks = make([]entry[V], len(keys)), make([]bool, len(keys))
+		for i, key := range keys {
+			es[i], oks[i], err = s.getEntry(ctx, key)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		return es, oks, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	for i := range es {
+		oks[i] = oks[i] && !es[i].CreatedAt.IsZero()
+	}
+	return es, oks, nil
+}
+
+// isDecodeError reports whether err is the failure of the cache store to
+// decode a value as an envelope.
+func isDecodeError(err error) bool {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	return errors.Is(err, cachestore.ErrBackendTypeCast) || errors.As(err, &syntaxErr) || errors.As(err, &typeErr)
+}
+
+// entryMeta holds the in-process state of a cached key, which is only
+// relevant to the stampede instance holding it.
+type entryMeta struct {
+	// err is the cached error of the last fetch, which is replayed to
+	// callers until errUntil.
+	err      error
+	errUntil time.Time
+
+	// refreshing is set while a background refresh of the key is running.
+	refreshing bool
+}
+
+// entryTable is the in-process state table for cached keys, ie. their cached
+// errors and in-flight fetches.
+type entryTable struct {
+	mu   sync.Mutex
+	m    map[string]*entryMeta
+	adds int
+
+	// fetching holds the id of the current fetch of each key, so the result
+	// of a fetch which was forgotten or invalidated in the meantime is not
+	// written to the cache.
+	fetching map[string]uint64
+	fetchSeq uint64
+}
+
+// entryTableSweepEvery is the number of entries added to the table after
+// which expired entries are swept from it.
+const entryTableSweepEvery = 1024
+
+func newEntryTable() *entryTable {
+	return &entryTable{
+		m:        make(map[string]*entryMeta),
+		fetching: make(map[string]uint64),
+	}
+}
+
+// getErr returns the cached error for key, if any.
+func (t *entryTable) getErr(key string) (error, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e, ok := t.m[key]
+	if !ok || e.err == nil || time.Now().After(e.errUntil) {
+		return nil, false
+	}
+	return e.err, true
+}
+
+// setErr caches the error of a failed fetch for key, for the given ttl.
+func (t *entryTable) setErr(key string, err error, ttl time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e := t.add(key)
+	e.err = err
+	e.errUntil = time.Now().Add(ttl)
+}
+
+// set records that a fresh value was cached for key, which clears its
+// cached error.
+func (t *entryTable) set(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if e, ok := t.m[key]; ok {
+		e.err = nil
+		e.errUntil = time.Time{}
+		t.removeExpired(key, e)
+	}
+}
+
+// startRefresh marks key as being refreshed in the background. It returns
+// false if a refresh is already running.
+func (t *entryTable) startRefresh(key string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e := t.add(key)
+	if e.refreshing {
+		return false
+	}
+	e.refreshing = true
+	return true
+}
+
+// endRefresh clears the refreshing mark of key.
+func (t *entryTable) endRefresh(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if e, ok := t.m[key]; ok {
+		e.refreshing = false
+		t.removeExpired(key, e)
+	}
+}
+
+// beginFetch registers a new fetch of key, and returns its id.
+func (t *entryTable) beginFetch(key string) uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.fetchSeq++
+	t.fetching[key] = t.fetchSeq
+	return t.fetchSeq
+}
+
+// isFetching reports whether key is currently being fetched.
+func (t *entryTable) isFetching(key string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, ok := t.fetching[key]
+	return ok
+}
+
+// endFetch unregisters the fetch of key with the given id, and reports
+// whether it's still current, ie. it was not forgotten in the meantime.
+func (t *entryTable) endFetch(key string, id uint64) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.fetching[key] != id {
+		return false
+	}
+	delete(t.fetching, key)
+	return true
+}
+
+// forget unregisters the current fetch of key, if any.
+func (t *entryTable) forget(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.fetching, key)
+}
+
+// forgetPrefix unregisters the current fetches of all keys with the given
+// prefix, and returns their keys.
+func (t *entryTable) forgetPrefix(prefix string) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var keys []string
+	for k := range t.fetching {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+			delete(t.fetching, k)
+		}
+	}
+	return keys
+}
+
+// delete removes the metadata and cached error of key.
+func (t *entryTable) delete(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.m, key)
+}
+
+// deletePrefix removes the metadata and cached errors of all keys with the
+// given prefix.
+func (t *entryTable) deletePrefix(prefix string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for k := range t.m {
+		if strings.HasPrefix(k, prefix) {
+			delete(t.m, k)
+		}
+	}
+}
+
+// add returns the entry of key, which is added to the table if missing.
+// Expired entries are swept every entryTableSweepEvery additions, so the
+// table doesn't grow with every key which failed or was refreshed once, ie.
+// during an upstream outage. Must be called with t.mu held.
+func (t *entryTable) add(key string) *entryMeta {
+	if e, ok := t.m[key]; ok {
+		return e
+	}
+	t.adds++
+	if t.adds >= entryTableSweepEvery {
+		t.adds = 0
+		t.sweep()
+	}
+	e := &entryMeta{}
+	t.m[key] = e
+	return e
+}
+
+// removeExpired removes the entry e of key if it has expired. Must be called
+// with t.mu held.
+func (t *entryTable) removeExpired(key string, e *entryMeta) {
+	if e.expired(time.Now()) {
+		delete(t.m, key)
+	}
+}
+
+// sweep removes expired entries. Must be called with t.mu held.
+func (t *entryTable) sweep() {
+	now := time.Now()
+	for k, e := range t.m {
+		if e.expired(now) {
+			delete(t.m, k)
+		}
+	}
+}
+
+// expired reports whether the entry holds neither a value nor an error
+// at time now, and can be removed from the table.
+func (e *entryMeta) expired(now time.Time) bool {
+	return now.After(e.errUntil) && !e.refreshing
+}
+
+// newEntry returns the envelope of a value fetched at createdAt, which took
+// delta to fetch and stays fresh for ttl.
+func newEntry[V any](v V, createdAt time.Time, delta, ttl time.Duration) entry[V] {
+	return entry[V]{Value: v, CreatedAt: createdAt, FreshUntil: createdAt.Add(ttl), Delta: delta}
+}
+
+// isStale reports whether the value is past its soft expiry at time now.
+// A value without metadata is always stale.
+func (e entry[V]) isStale(now time.Time) bool {
+	return now.After(e.FreshUntil)
+}
+
+// staleFor returns how long the value has been past its soft expiry at time
+// now, or 0 if it's still fresh.
+func (e entry[V]) staleFor(now time.Time) time.Duration {
+	return max(now.Sub(e.FreshUntil), 0)
+}
+
+// expireEarly reports whether the value should be recomputed ahead of its
+// expiry, using the probabilistic early expiration of the XFetch algorithm
+// (Vattani et al., "Optimal Probabilistic Cache Stampede Prevention"). The
+// probability grows as the expiry approaches, scaled by how long the value
+// took to fetch and by beta, where beta > 1 favours earlier recomputation.
+func (e entry[V]) expireEarly(now time.Time, beta float64) bool {
+	if beta <= 0 || e.Delta <= 0 {
+		return false
+	}
+	gap := time.Duration(float64(e.Delta) * beta * -math.Log(1-rand.Float64()))
+	return !now.Add(gap).Before(e.FreshUntil)
+}
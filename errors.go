@@ -0,0 +1,52 @@
+package stampede
+
+import (
+	"fmt"
+	"runtime/debug"
+	"time"
+)
+
+// StaleError is returned by Do along with a stale value, when refreshing an
+// expired value failed and the stale value was served instead, as enabled by
+// WithStaleIfError. Use errors.As to detect it and keep the returned value.
+type StaleError struct {
+	// Err is the error of the failed refresh.
+	Err error
+
+	// StaleFor is how long the served value has been past its TTL.
+	StaleFor time.Duration
+}
+
+func (e *StaleError) Error() string {
+	return fmt.Sprintf("stampede: serving value stale for %s: %v", e.StaleFor, e.Err)
+}
+
+func (e *StaleError) Unwrap() error {
+	return e.Err
+}
+
+// PanicError is returned by Do to every caller waiting on a fetch whose fetch
+// function panicked, instead of crashing the process or leaving the callers
+// hanging. The caller which started the fetch may re-panic instead, as
+// enabled by WithRepanic.
+type PanicError struct {
+	// Value is the value passed to panic.
+	Value any
+
+	// Stack is the stack trace of the goroutine which panicked.
+	Stack []byte
+}
+
+func newPanicError(v any) *PanicError {
+	return &PanicError{Value: v, Stack: debug.Stack()}
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("stampede: fetch panicked: %v\n\n%s", e.Value, e.Stack)
+}
+
+// Unwrap returns the panic value, if it's an error.
+func (e *PanicError) Unwrap() error {
+	err, _ := e.Value.(error)
+	return err
+}
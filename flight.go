@@ -0,0 +1,228 @@
+package stampede
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"time"
+
+	"github.com/goware/singleflight"
+)
+
+// fetchFunc fetches the value of a key, optionally returning its ttl.
+type fetchFunc[V any] func(ctx context.Context) (V, *time.Duration, error)
+
+// callFetch calls fn for key, retrying failed calls as set in opts. The
+// calls and the backoff between them are bounded by the fetch timeout. The
+// call is short-circuited with ErrCircuitOpen while the circuit breaker of
+// the key is open.
+func (s *Stampede[V]) callFetch(ctx context.Context, key string, fn fetchFunc[V], opts *Options) (result doResult[V], err error) {
+	if s.opts().CircuitBreakerThreshold > 0 && !opts.batched {
+		group := s.circuitGroup(key)
+		if !s.circuits.allow(group) {
+			return result, ErrCircuitOpen
+		}
+		defer func() {
+			s.circuits.done(group, err, s.opts().CircuitBreakerThreshold, s.opts().CircuitBreakerCooldown)
+		}()
+	}
+
+	if opts.FetchTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.FetchTimeout)
+		defer cancel()
+	}
+
+	backoff := retryBackoff(opts)
+	for retry := 0; ; retry++ {
+		if opts.HedgeDelay > 0 {
+			result, err = s.hedgeFetch(ctx, key, fn, opts)
+		} else {
+			result, err = s.callFetchOnce(ctx, key, fn)
+		}
+		if err == nil || retry >= opts.Retries || !retryable(err, opts) || !waitBackoff(ctx, backoff) {
+			return result, err
+		}
+		backoff *= 2
+	}
+}
+
+// retryBackoff returns the backoff before the first retry of a failed fetch.
+func retryBackoff(opts *Options) time.Duration {
+	if opts.RetryBackoff <= 0 {
+		return DefaultRetryBackoff
+	}
+	return opts.RetryBackoff
+}
+
+// waitBackoff waits for the backoff before a retry, with jitter over the
+// upper half of the backoff so the retries of different keys are spread out.
+// It reports false if ctx is done first.
+func waitBackoff(ctx context.Context, backoff time.Duration) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	timer := time.NewTimer(backoff/2 + rand.N(backoff/2+1))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// retryable reports whether the failed fetch with err may be retried.
+func retryable(err error, opts *Options) bool {
+	var perr *PanicError
+	if errors.As(err, &perr) {
+		return false
+	}
+	return opts.RetryFilter == nil || opts.RetryFilter(err)
+}
+
+// callFetchOnce calls fn for key, and reports the call to the observer.
+func (s *Stampede[V]) callFetchOnce(ctx context.Context, key string, fn fetchFunc[V]) (doResult[V], error) {
+	createdAt := time.Now()
+	v, ttl, err := callFn(ctx, fn)
+	s.observe().Fetch(key, time.Since(createdAt), err)
+	return doResult[V]{Value: v, TTL: ttl, CreatedAt: createdAt}, err
+}
+
+// hedgeFetch calls fn for key, and calls it a second time if the first call
+// hasn't returned after the hedge delay of opts. The first successful call
+// wins, and the other one is cancelled. If both calls fail, the error of the
+// last one is returned.
+func (s *Stampede[V]) hedgeFetch(ctx context.Context, key string, fn fetchFunc[V], opts *Options) (doResult[V], error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type hedgedResult struct {
+		result doResult[V]
+		err    error
+	}
+	// buffered, so the losing call doesn't block once we've returned
+	results := make(chan hedgedResult, 2)
+	call := func() {
+		result, err := s.callFetchOnce(ctx, key, fn)
+		results <- hedgedResult{result, err}
+	}
+
+	hedge := time.NewTimer(opts.HedgeDelay)
+	defer hedge.Stop()
+
+	go call()
+	var last hedgedResult
+	for calls := 1; calls > 0; {
+		select {
+		case <-hedge.C:
+			calls++
+			go call()
+		case last = <-results:
+			calls--
+			if last.err == nil {
+				return last.result, nil
+			}
+		}
+	}
+	return last.result, last.err
+}
+
+// callFn calls fn, recovering a panic into a *PanicError.
+func callFn[V any](ctx context.Context, fn fetchFunc[V]) (v V, ttl *time.Duration, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = newPanicError(r)
+		}
+	}()
+	return fn(ctx)
+}
+
+// flight runs fetch for key through the callGroup, so concurrent callers
+// share a single fetch. The caller stops waiting on the fetch once ctx is
+// done, and the fetch context is cancelled once every caller has stopped
+// waiting on it.
+func (s *Stampede[V]) flight(ctx context.Context, key string, fetch func(ctx context.Context) (doResult[V], error), opts *Options) (doResult[V], bool, error) {
+	return s.waitFlight(ctx, s.startFlight(ctx, key, fetch), opts)
+}
+
+// flightWait is a caller waiting on the flight of a key.
+type flightWait[V any] struct {
+	key string
+	ch  <-chan singleflight.Result[doResult[V]]
+
+	// leader is set when the fetch of the caller is the one run by the
+	// flight. It may only be read once the result was received from ch.
+	leader bool
+
+	// end ends the tracing of the wait.
+	end func(leader bool, fetch context.Context, err error)
+}
+
+// startFlight is like flight, but returns the wait on the flight instead
+// of waiting on it, see waitFlight.
+func (s *Stampede[V]) startFlight(ctx context.Context, key string, fetch func(ctx context.Context) (doResult[V], error)) *flightWait[V] {
+	tracer := s.tracer()
+	ctx, end := tracer.Wait(ctx, key)
+	w := &flightWait[V]{key: key, end: end}
+	if s.opts().Tracer != nil {
+		s.waiters.add(key, 1)
+	}
+	w.ch = s.callGroup.DoChanContext(ctx, key, func(fctx context.Context) (result doResult[V], err error) {
+		w.leader = true
+		if !s.lifecycle.add() {
+			return result, ErrClosed
+		}
+		defer s.lifecycle.done()
+		fctx, endFetch := tracer.Fetch(flightContext{Context: fctx, values: ctx}, key)
+		// the fetch runs on its own goroutine, where a panic would crash the
+		// process. A panic of the fetch function is already recovered by
+		// callFn, this also covers the rest of the fetch.
+		defer func() {
+			if r := recover(); r != nil {
+				err = newPanicError(r)
+			}
+			endFetch(s.waiters.get(key), err)
+			result.traceCtx = fctx
+		}()
+		return fetch(fctx)
+	})
+	return w
+}
+
+// waitFlight waits on the result of a flight, until ctx is done. It also
+// reports whether the fetch was shared by several callers. If the fetch
+// panicked, its *PanicError is returned to every caller, except to the
+// leader which re-panics with it when WithRepanic is set.
+func (s *Stampede[V]) waitFlight(ctx context.Context, w *flightWait[V], opts *Options) (doResult[V], bool, error) {
+	if s.opts().Tracer != nil {
+		defer s.waiters.add(w.key, -1)
+	}
+	select {
+	case res := <-w.ch:
+		w.end(w.leader, res.Val.traceCtx, res.Err)
+		if perr, ok := res.Err.(*PanicError); ok && w.leader && opts.Repanic {
+			panic(perr)
+		}
+		return res.Val, res.Shared, res.Err
+	case <-ctx.Done():
+		w.end(false, nil, ctx.Err())
+		var result doResult[V]
+		return result, false, ctx.Err()
+	}
+}
+
+// flightContext is the context of a shared fetch. It carries the values of
+// the context of the caller which started the fetch (ie. tracing spans),
+// while its cancellation is tied to all the callers waiting on the fetch.
+type flightContext struct {
+	context.Context
+	values context.Context
+}
+
+func (c flightContext) Value(key any) any {
+	if v := c.Context.Value(key); v != nil {
+		return v
+	}
+	return c.values.Value(key)
+}
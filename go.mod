@@ -6,6 +6,7 @@ toolchain go1.24.2
 
 require (
 	github.com/go-chi/cors v1.2.1
+	github.com/goware/cachestore-mem v0.2.1
 	github.com/goware/cachestore2 v0.12.2
 	github.com/goware/singleflight v0.3.0
 	github.com/stretchr/testify v1.10.0
@@ -14,6 +15,7 @@ require (
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/elastic/go-freelru v0.16.0 // indirect
 	github.com/klauspost/cpuid/v2 v2.2.10 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	golang.org/x/sys v0.32.0 // indirect
@@ -3,11 +3,13 @@ package stampede
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 
 	cachestore "github.com/goware/cachestore2"
@@ -18,6 +20,19 @@ func Handler(logger *slog.Logger, cacheBackend cachestore.Backend, ttl time.Dura
 }
 
 func HandlerWithKey(logger *slog.Logger, cacheBackend cachestore.Backend, ttl time.Duration, cacheKeyFunc CacheKeyFunc, options ...Option) func(next http.Handler) http.Handler {
+	return NewHTTPHandler(logger, cacheBackend, ttl, cacheKeyFunc, options...).Handler
+}
+
+// HTTPHandler is the stampede HTTP middleware along with its stampede
+// instance, so it may be closed on shutdown, see Shutdown.
+type HTTPHandler struct {
+	stampede *Stampede[responseValue]
+	handler  func(next http.Handler) http.Handler
+}
+
+// NewHTTPHandler is like HandlerWithKey, but returns the middleware as an
+// HTTPHandler, which may be closed on shutdown.
+func NewHTTPHandler(logger *slog.Logger, cacheBackend cachestore.Backend, ttl time.Duration, cacheKeyFunc CacheKeyFunc, options ...Option) *HTTPHandler {
 	opts := getOptions(ttl, options...)
 
 	// Combine various cache key functions into a single cache key value.
@@ -51,19 +66,35 @@ func HandlerWithKey(logger *slog.Logger, cacheBackend cachestore.Backend, ttl ti
 		return cacheKey1 + cacheKey2 + cacheKey3 + cacheKey4, nil
 	}
 
-	var cache cachestore.Store[responseValue]
-	if cacheBackend != nil {
-		cache = cachestore.OpenStore[responseValue](cacheBackend)
-	}
-	h := stampedeHandler(logger, cache, comboCacheKeyFunc, opts)
+	stampede := NewStampede[responseValue](logger, cacheBackend)
+	stampede.SetOptions(opts)
 
-	return func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			h(next).ServeHTTP(w, r)
-		})
+	return &HTTPHandler{
+		stampede: stampede,
+		handler:  stampedeHandler(logger, stampede, comboCacheKeyFunc, opts),
 	}
 }
 
+// Handler returns the middleware, wrapping next.
+func (h *HTTPHandler) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.handler(next).ServeHTTP(w, r)
+	})
+}
+
+// Close closes the stampede instance of the middleware, which waits for its
+// background fetches and cache writes, until ctx is done. Requests served
+// after Close bypass the cache, and are passed straight to the next handler.
+func (h *HTTPHandler) Close(ctx context.Context) error {
+	return h.stampede.Close(ctx)
+}
+
+// InvalidateTag removes all responses cached with tag, see CacheTagHeader
+// and Stampede.InvalidateTag.
+func (h *HTTPHandler) InvalidateTag(ctx context.Context, tag string) error {
+	return h.stampede.InvalidateTag(ctx, tag)
+}
+
 func cacheKeyWithRequestURL(r *http.Request) (uint64, error) {
 	return StringToHash(strings.ToLower(r.URL.Path)), nil
 }
@@ -110,26 +141,46 @@ func cacheKeyWithRequestHeaders(headers []string) func(r *http.Request) (uint64,
 
 type CacheKeyFunc func(r *http.Request) (uint64, error)
 
-func stampedeHandler(logger *slog.Logger, cache cachestore.Store[responseValue], cacheKeyFunc CacheKeyFunc, options *Options) func(next http.Handler) http.Handler {
-	stampede := NewStampede(logger, cache)
-	stampede.SetOptions(options)
-
+func stampedeHandler(logger *slog.Logger, stampede *Stampede[responseValue], cacheKeyFunc CacheKeyFunc, options *Options) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			cacheKey, err := cacheKeyFunc(r)
 			if err != nil {
 				logger.Warn("stampede: fail to compute cache key", "err", err)
+				stampede.observe().Error("", err)
 				next.ServeHTTP(w, r)
 				return
 			}
 
-			firstRequest := false
+			fetch := &inlineFetch{done: make(chan struct{})}
+
+			cachedVal, err := stampede.DoCtx(r.Context(), fmt.Sprintf("http:%d", cacheKey), func(ctx context.Context) (responseValue, *time.Duration, error) {
+				// the request is served with the context of the shared fetch,
+				// which carries the values of the request, but is only
+				// cancelled once all the requests waiting on it have gone
+				// away, so the response isn't cut short when the client of
+				// this request disconnects.
+				w, r := w, r.WithContext(ctx)
+				if fetch.begin() {
+					defer fetch.end()
+				} else {
+					// revalidating in the background, the client has already been
+					// served so we only record the response.
+					w = &discardResponseWriter{header: http.Header{}}
+				}
 
-			cachedVal, err := stampede.Do(context.Background(), fmt.Sprintf("http:%d", cacheKey), func() (responseValue, *time.Duration, error) {
-				firstRequest = true
 				buf := bytes.NewBuffer(nil)
 				ww := &responseWriter{ResponseWriter: w, tee: buf}
 
+				defer func() {
+					if r := recover(); r != nil {
+						// reply with an error unless the handler has already
+						// replied, the panic is then turned into a *PanicError
+						// for the requests waiting on this one.
+						ww.WriteHeader(http.StatusInternalServerError)
+						panic(r)
+					}
+				}()
 				next.ServeHTTP(ww, r)
 
 				val := responseValue{
@@ -151,11 +202,35 @@ func stampedeHandler(logger *slog.Logger, cache cachestore.Store[responseValue],
 				return val, ttl, nil
 			})
 
-			if firstRequest {
+			var perr *PanicError
+			panicked := errors.As(err, &perr)
+			if fetch.served() {
+				if panicked {
+					// the handler panicked while serving this request, which
+					// was replied with an error. The panic doesn't reach the
+					// recovery of the server, so it's logged here, once for
+					// all the requests waiting on it.
+					logger.Error("stampede: handler panicked", "err", perr.Value, "stack", string(perr.Stack))
+				}
 				return
 			}
 
 			// handle response for subsequent requests
+			if err != nil && r.Context().Err() != nil {
+				// the client has gone away while waiting on the response
+				return
+			}
+			if panicked {
+				// the handler panicked while serving another request, which
+				// has logged the panic, and is not retried here.
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+			if err == ErrClosed {
+				// shutting down, serve the request without the cache
+				next.ServeHTTP(w, r)
+				return
+			}
 			if err != nil {
 				logger.Error("stampede: fail to get value, serving standard request handler", "err", err)
 				next.ServeHTTP(w, r)
@@ -195,6 +270,11 @@ func stampedeHandler(logger *slog.Logger, cache cachestore.Store[responseValue],
 	}
 }
 
+// CacheTagHeader is the response header with the comma-separated tags of a
+// response cached by the HTTP middleware, along with the tags of WithTags,
+// see HTTPHandler.InvalidateTag.
+const CacheTagHeader = "Cache-Tag"
+
 type responseValue struct {
 	Headers http.Header `json:"headers"`
 	Status  int         `json:"status"`
@@ -202,6 +282,77 @@ type responseValue struct {
 	Skip    bool        `json:"skip"`
 }
 
+var _ Tagger = responseValue{}
+
+func (v responseValue) CacheTags() []string {
+	var tags []string
+	for _, header := range v.Headers.Values(CacheTagHeader) {
+		for _, tag := range strings.Split(header, ",") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				tags = append(tags, tag)
+			}
+		}
+	}
+	return tags
+}
+
+// inlineFetch tracks whether the fetch function of a request ran inline,
+// writing the response directly to the client, or detached in the background
+// after the client was already served, ie. when revalidating a stale value.
+type inlineFetch struct {
+	mu       sync.Mutex
+	started  bool
+	detached bool
+	done     chan struct{}
+}
+
+// begin is called when the fetch function starts, and reports whether it
+// may write to the client.
+func (f *inlineFetch) begin() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.detached {
+		return false
+	}
+	f.started = true
+	return true
+}
+
+func (f *inlineFetch) end() {
+	close(f.done)
+}
+
+// served reports whether the fetch function ran inline and has written the
+// response to the client, waiting for it to finish if needed. Otherwise, any
+// later run of the fetch function is detached from the client.
+func (f *inlineFetch) served() bool {
+	f.mu.Lock()
+	if !f.started {
+		f.detached = true
+		f.mu.Unlock()
+		return false
+	}
+	f.mu.Unlock()
+	<-f.done
+	return true
+}
+
+// discardResponseWriter is used by fetches which are detached from a client,
+// where only the recorded response value is of interest.
+type discardResponseWriter struct {
+	header http.Header
+}
+
+func (d *discardResponseWriter) Header() http.Header {
+	return d.header
+}
+
+func (d *discardResponseWriter) Write(buf []byte) (int, error) {
+	return len(buf), nil
+}
+
+func (d *discardResponseWriter) WriteHeader(code int) {}
+
 type responseWriter struct {
 	http.ResponseWriter
 	wroteHeader bool
@@ -1,6 +1,9 @@
 package stampede_test
 
 import (
+	"bytes"
+	"context"
+	"fmt"
 	"io"
 	"log"
 	"log/slog"
@@ -373,3 +376,219 @@ func TestEmptyHandlerFunc(t *testing.T) {
 		t.Log(resp.StatusCode)
 	}
 }
+
+func TestHTTPStaleWhileRevalidate(t *testing.T) {
+	var hits atomic.Int64
+
+	app := func(w http.ResponseWriter, r *http.Request) {
+		n := hits.Add(1)
+		time.Sleep(100 * time.Millisecond)
+		w.WriteHeader(200)
+		w.Write([]byte(fmt.Sprintf("hit %d", n)))
+	}
+
+	cache := newMockCacheBackend()
+	h := stampede.Handler(slog.Default(), cache, 300*time.Millisecond, stampede.WithStaleWhileRevalidate(5*time.Second))
+
+	ts := httptest.NewServer(h(http.HandlerFunc(app)))
+	defer ts.Close()
+
+	get := func() (string, string) {
+		resp, err := http.Get(ts.URL)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return string(body), resp.Header.Get("x-cache")
+	}
+
+	body, _ := get()
+	assert.Equal(t, "hit 1", body)
+
+	// let the value go stale, it's still served while revalidating
+	time.Sleep(350 * time.Millisecond)
+	body, xcache := get()
+	assert.Equal(t, "hit 1", body)
+	assert.Equal(t, "hit", xcache)
+
+	// wait for the background refresh to complete
+	time.Sleep(200 * time.Millisecond)
+	body, _ = get()
+	assert.Equal(t, "hit 2", body)
+	assert.Equal(t, int64(2), hits.Load())
+}
+
+func TestHTTPHandlerPanic(t *testing.T) {
+	var numCalls atomic.Int64
+	h := stampede.Handler(slog.Default(), newMockCacheBackend(), 5*time.Second)
+	server := httptest.NewServer(h(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		numCalls.Add(1)
+		time.Sleep(200 * time.Millisecond)
+		panic("boom")
+	})))
+	defer server.Close()
+
+	// every request is replied with an error, without retrying the handler
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := http.Get(server.URL)
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer resp.Body.Close()
+			assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, int64(1), numCalls.Load())
+}
+
+func TestHTTPHandlerPanicLogged(t *testing.T) {
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&logs, nil))
+	h := stampede.Handler(logger, newMockCacheBackend(), 5*time.Second)
+	endpoint := h(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	}))
+
+	// the panic of a lone request is logged along with its stack, as it
+	// doesn't reach the recovery of the server
+	w := httptest.NewRecorder()
+	endpoint.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	require.Equal(t, http.StatusInternalServerError, w.Code)
+	require.Contains(t, logs.String(), "stampede: handler panicked")
+	require.Contains(t, logs.String(), "err=boom")
+	require.Contains(t, logs.String(), "http_test.go")
+}
+
+func TestHTTPHandlerClientGone(t *testing.T) {
+	var numCalls atomic.Int64
+	h := stampede.Handler(slog.Default(), newMockCacheBackend(), 5*time.Second)
+	endpoint := h(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		numCalls.Add(1)
+		select {
+		case <-time.After(200 * time.Millisecond):
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("ok"))
+		case <-r.Context().Done():
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("aborted"))
+		}
+	}))
+
+	// the client of the first request goes away, while another request
+	// waits on its response
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		endpoint.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil).WithContext(ctx))
+	}()
+	time.Sleep(20 * time.Millisecond)
+	go func() {
+		time.Sleep(30 * time.Millisecond)
+		cancel()
+	}()
+
+	w := httptest.NewRecorder()
+	endpoint.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	wg.Wait()
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "ok", w.Body.String())
+	require.Equal(t, int64(1), numCalls.Load())
+}
+
+func TestHTTPHandlerShutdown(t *testing.T) {
+	var numCalls atomic.Int64
+	h := stampede.NewHTTPHandler(slog.Default(), newMockCacheBackend(), 5*time.Second, nil)
+	endpoint := h.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		numCalls.Add(1)
+		time.Sleep(100 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ok"))
+	}))
+	ts := httptest.NewServer(endpoint)
+	defer ts.Close()
+
+	// shutdown waits for the request in progress
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		resp, err := http.Get(ts.URL)
+		if assert.NoError(t, err) {
+			resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+		}
+	}()
+	time.Sleep(50 * time.Millisecond)
+	require.NoError(t, stampede.Shutdown(context.Background(), ts.Config, h))
+	<-done
+
+	// and once closed, requests bypass the cache
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		endpoint.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Empty(t, w.Header().Get("x-cache"))
+	}
+	require.Equal(t, int64(3), numCalls.Load())
+}
+
+func TestHTTPLocalCache(t *testing.T) {
+	var numCalls atomic.Int64
+	backend := newMockCacheBackend()
+	h := stampede.Handler(slog.Default(), backend, 5*time.Second, stampede.WithLocalCache(time.Second))
+	endpoint := h(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		numCalls.Add(1)
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ok"))
+	}))
+
+	w := httptest.NewRecorder()
+	endpoint.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	// the response is served from the local cache
+	require.NoError(t, backend.ClearAll(context.Background()))
+	w = httptest.NewRecorder()
+	endpoint.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "hit", w.Header().Get("x-cache"))
+	require.Equal(t, "ok", w.Body.String())
+	require.Equal(t, int64(1), numCalls.Load())
+}
+
+func TestHTTPInvalidateTag(t *testing.T) {
+	var numCalls atomic.Int64
+	h := stampede.NewHTTPHandler(slog.Default(), newMockCacheBackend(), 5*time.Second, nil)
+	endpoint := h.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		numCalls.Add(1)
+		w.Header().Set(stampede.CacheTagHeader, "account:"+r.URL.Query().Get("account")+", accounts")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ok"))
+	}))
+
+	get := func(path string) {
+		w := httptest.NewRecorder()
+		endpoint.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		require.Equal(t, http.StatusOK, w.Code)
+	}
+
+	get("/a?account=42")
+	get("/b?account=7")
+	require.Equal(t, int64(2), numCalls.Load())
+
+	require.NoError(t, h.InvalidateTag(context.Background(), "account:42"))
+	get("/a?account=42")
+	get("/b?account=7")
+	require.Equal(t, int64(3), numCalls.Load())
+
+	require.NoError(t, h.InvalidateTag(context.Background(), "accounts"))
+	get("/a?account=42")
+	get("/b?account=7")
+	require.Equal(t, int64(5), numCalls.Load())
+}
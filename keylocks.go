@@ -0,0 +1,32 @@
+package stampede
+
+import "sync"
+
+// keyLockStripes is the number of stripes of keyLocks.
+const keyLockStripes = 256
+
+// keyLocks are striped per-key locks, which order the cache write of a
+// fetched value with the invalidation of its key, so an invalidated value is
+// never written back to the cache. Cache reads don't take any lock, and the
+// writes of keys of different stripes don't contend.
+type keyLocks [keyLockStripes]sync.Mutex
+
+// lock locks the stripe of key, and returns it to be unlocked.
+func (l *keyLocks) lock(key string) *sync.Mutex {
+	mu := &l[StringToHash(key)%keyLockStripes]
+	mu.Lock()
+	return mu
+}
+
+// lockAll locks every stripe, ie. to invalidate a key prefix.
+func (l *keyLocks) lockAll() {
+	for i := range l {
+		l[i].Lock()
+	}
+}
+
+func (l *keyLocks) unlockAll() {
+	for i := range l {
+		l[i].Unlock()
+	}
+}
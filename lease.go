@@ -0,0 +1,194 @@
+package stampede
+
+import (
+	"context"
+	"math/rand/v2"
+	"strconv"
+	"sync"
+	"time"
+
+	cachestore "github.com/goware/cachestore2"
+)
+
+// Locker takes short leases on keys in a store shared by several replicas,
+// ie. Redis, to coalesce the fetches of a key across replicas, see
+// WithLocker and StoreLocker.
+type Locker interface {
+	// Lock takes the lease of key for ttl on behalf of owner, and reports
+	// whether it was taken. It must be atomic across replicas, ie. with the
+	// Redis command SET key owner NX PX ttl.
+	Lock(ctx context.Context, key, owner string, ttl time.Duration) (bool, error)
+
+	// Unlock releases the lease of key, if it's still held by owner.
+	Unlock(ctx context.Context, key, owner string) error
+}
+
+// lease coordinates the fetch of key with the other replicas sharing the
+// Locker of the stampede instance. It takes the lease of key, and returns a
+// func to release it once the fetched value is cached. Otherwise, another
+// replica is fetching the key, and lease polls the cache until its value
+// shows up, which is returned as found. The lease of a replica which died
+// while fetching expires, and is then taken over.
+//
+// Only a value written after the lease was first observed is returned, so
+// a stale value, or the value being refreshed ahead of its expiry, is never
+// mistaken for the value fetched by another replica.
+func (s *Stampede[V]) lease(ctx context.Context, key string) (release func(), e entry[V], found bool, err error) {
+	// written returns the value of key, if a fresh value was written since
+	// the value first observed
+	prev, hasPrev, _ := s.getEntry(ctx, key)
+	written := func() (entry[V], bool) {
+		e, ok, err := s.getEntry(ctx, key)
+		if err != nil || !ok || e.isStale(time.Now()) || (hasPrev && e.CreatedAt.Equal(prev.CreatedAt)) {
+			return e, false
+		}
+		return e, true
+	}
+
+	// wait on the value of another replica holding the lease
+	release, err = s.takeLease(ctx, s.opts().Locker, key, func() bool {
+		e, found = written()
+		return found
+	})
+	if err != nil || found {
+		return nil, e, found, err
+	}
+	// another replica may have released the lease right after caching the
+	// value
+	if e, ok := written(); ok {
+		release()
+		return nil, e, true, nil
+	}
+	return release, e, false, nil
+}
+
+// takeLease takes the lease of key with locker, and returns a func to
+// release it. While another replica holds the lease, it's polled, and done
+// is called after each wait: once done reports true, takeLease stops
+// waiting, and returns a nil release. A Locker error is logged, and returns
+// a no-op release, so the caller goes on without the lease rather than fail.
+func (s *Stampede[V]) takeLease(ctx context.Context, locker Locker, key string, done func() bool) (release func(), err error) {
+	leaseKey := key + ":lease"
+	owner := strconv.FormatUint(rand.Uint64(), 36)
+	ttl := s.lockTTL()
+	poll := s.lockPollInterval()
+
+	for {
+		locked, err := locker.Lock(ctx, leaseKey, owner, ttl)
+		if err != nil {
+			s.logger.Warn("stampede: fail to take lease", "key", key, "err", err)
+			s.observe().Error(key, err)
+			return func() {}, nil
+		}
+		if locked {
+			return func() {
+				if err := locker.Unlock(context.WithoutCancel(ctx), leaseKey, owner); err != nil {
+					s.logger.Warn("stampede: fail to release lease", "key", key, "err", err)
+				}
+			}, nil
+		}
+
+		timer := time.NewTimer(poll)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+		if done != nil && done() {
+			return nil, nil
+		}
+	}
+}
+
+// lockTTL returns the TTL of the leases taken with the Locker.
+func (s *Stampede[V]) lockTTL() time.Duration {
+	if s.opts().LockTTL <= 0 {
+		return DefaultLockTTL
+	}
+	return s.opts().LockTTL
+}
+
+// lockPollInterval returns how often a lease held by another replica is
+// polled.
+func (s *Stampede[V]) lockPollInterval() time.Duration {
+	if s.opts().LockPollInterval <= 0 {
+		return DefaultLockPollInterval
+	}
+	return s.opts().LockPollInterval
+}
+
+// StoreLocker is a Locker over a cache backend, ie. the one shared by the
+// replicas for their cached values, so fetches are coalesced across replicas
+// without any other store. A lease is the value of its key in the cache
+// backend, set with the GetOrSetWithLockEx method of the backend, whose
+// lock makes the lease exclusive, ie. with cachestore-redis.
+type StoreLocker struct {
+	store cachestore.Store[string]
+}
+
+var _ Locker = &StoreLocker{}
+
+// NewStoreLocker returns a Locker taking the leases in cacheBackend.
+func NewStoreLocker(cacheBackend cachestore.Backend) *StoreLocker {
+	return &StoreLocker{store: cachestore.OpenStore[string](cacheBackend)}
+}
+
+// Lock sets owner as the value of key, unless it's already set, and reports
+// whether the lease was taken by owner.
+func (l *StoreLocker) Lock(ctx context.Context, key, owner string, ttl time.Duration) (bool, error) {
+	v, err := l.store.GetOrSetWithLockEx(ctx, key, func(context.Context, string) (string, error) {
+		return owner, nil
+	}, ttl)
+	if err != nil {
+		return false, err
+	}
+	return v == owner, nil
+}
+
+// Unlock deletes key, if its value is still owner.
+func (l *StoreLocker) Unlock(ctx context.Context, key, owner string) error {
+	v, ok, err := l.store.Get(ctx, key)
+	if err != nil || !ok || v != owner {
+		return err
+	}
+	return l.store.Delete(ctx, key)
+}
+
+// MemLocker is an in-process Locker, ie. to test the coalescing of fetches
+// across replicas with several stampede instances standing in for them.
+type MemLocker struct {
+	mu     sync.Mutex
+	leases map[string]memLease
+}
+
+type memLease struct {
+	owner     string
+	expiresAt time.Time
+}
+
+var _ Locker = &MemLocker{}
+
+func NewMemLocker() *MemLocker {
+	return &MemLocker{leases: make(map[string]memLease)}
+}
+
+func (l *MemLocker) Lock(ctx context.Context, key, owner string, ttl time.Duration) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if lease, ok := l.leases[key]; ok && now.Before(lease.expiresAt) {
+		return false, nil
+	}
+	l.leases[key] = memLease{owner: owner, expiresAt: now.Add(ttl)}
+	return true, nil
+}
+
+func (l *MemLocker) Unlock(ctx context.Context, key, owner string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if lease, ok := l.leases[key]; ok && lease.owner == owner {
+		delete(l.leases, key)
+	}
+	return nil
+}
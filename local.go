@@ -0,0 +1,148 @@
+package stampede
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// localCacheShards is the maximum number of shards of the local cache, which
+// are locked independently, so the lookups of different keys don't contend
+// on a single lock.
+const localCacheShards = 64
+
+// localCacheEvictSamples is the number of entries sampled to pick the entry
+// evicted from a full shard, which bounds the cost of an insert.
+const localCacheEvictSamples = 5
+
+// localCache is the in-process L1 cache of a stampede instance, in front of
+// its cache store, see WithLocalCache. It holds values for a short TTL, and
+// evicts entries close to their expiry once full.
+type localCache[V any] struct {
+	ttl    time.Duration
+	shards []localShard[V]
+}
+
+// localShard is a shard of the local cache, holding up to size entries.
+type localShard[V any] struct {
+	mu   sync.Mutex
+	size int
+	m    map[string]localEntry[V]
+}
+
+type localEntry[V any] struct {
+	value     V
+	expiresAt time.Time
+}
+
+// newLocalCache returns the local cache set in opts, or nil if disabled.
+func newLocalCache[V any](opts *Options) *localCache[V] {
+	if opts.LocalCacheTTL <= 0 {
+		return nil
+	}
+	size := opts.LocalCacheSize
+	if size <= 0 {
+		size = DefaultLocalCacheSize
+	}
+	c := &localCache[V]{
+		ttl:    opts.LocalCacheTTL,
+		shards: make([]localShard[V], min(size, localCacheShards)),
+	}
+	for i := range c.shards {
+		c.shards[i].size = (size + len(c.shards) - 1) / len(c.shards)
+		c.shards[i].m = make(map[string]localEntry[V])
+	}
+	return c
+}
+
+// shard returns the shard of key.
+func (c *localCache[V]) shard(key string) *localShard[V] {
+	return &c.shards[StringToHash(key)%uint64(len(c.shards))]
+}
+
+// get returns the value of key, if any. A nil cache is always empty.
+func (c *localCache[V]) get(key string) (V, bool) {
+	var v V
+	if c == nil {
+		return v, false
+	}
+	sh := c.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	e, ok := sh.m[key]
+	if !ok {
+		return v, false
+	}
+	if time.Now().After(e.expiresAt) {
+		delete(sh.m, key)
+		return v, false
+	}
+	return e.value, true
+}
+
+// set caches the value of key, for the TTL of the cache or for ttl,
+// whichever is shorter. A ttl <= 0 is ignored.
+func (c *localCache[V]) set(key string, v V, ttl time.Duration) {
+	if c == nil {
+		return
+	}
+	if ttl <= 0 || ttl > c.ttl {
+		ttl = c.ttl
+	}
+	now := time.Now()
+	sh := c.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if _, ok := sh.m[key]; !ok && len(sh.m) >= sh.size {
+		sh.evict(now)
+	}
+	sh.m[key] = localEntry[V]{value: v, expiresAt: now.Add(ttl)}
+}
+
+// evict removes an entry of the full shard, which is the first expired
+// entry among a few sampled ones, or else the sampled entry closest to its
+// expiry. Must be called with sh.mu held.
+func (sh *localShard[V]) evict(now time.Time) {
+	var victim string
+	var victimExpiresAt time.Time
+	n := 0
+	for k, e := range sh.m {
+		if now.After(e.expiresAt) {
+			delete(sh.m, k)
+			return
+		}
+		if n == 0 || e.expiresAt.Before(victimExpiresAt) {
+			victim, victimExpiresAt = k, e.expiresAt
+		}
+		if n++; n >= localCacheEvictSamples {
+			break
+		}
+	}
+	delete(sh.m, victim)
+}
+
+func (c *localCache[V]) delete(key string) {
+	if c == nil {
+		return
+	}
+	sh := c.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	delete(sh.m, key)
+}
+
+func (c *localCache[V]) deletePrefix(prefix string) {
+	if c == nil {
+		return
+	}
+	for i := range c.shards {
+		sh := &c.shards[i]
+		sh.mu.Lock()
+		for k := range sh.m {
+			if strings.HasPrefix(k, prefix) {
+				delete(sh.m, k)
+			}
+		}
+		sh.mu.Unlock()
+	}
+}
@@ -0,0 +1,255 @@
+package stampede
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrNotFound is the error of a key which was not returned by the fetch
+// function of DoMulti.
+var ErrNotFound = errors.New("stampede: key not found")
+
+// DoMulti returns the values for keys, reading them from the cache in a
+// single batch. The keys missing from the cache are fetched with a single
+// call of fn, while the keys already being fetched by another caller share
+// that fetch. Keys which are not returned by fn are omitted from the result,
+// and are negatively cached with ErrNotFound when WithErrorTTL is set, so
+// DoMulti doesn't fetch them again until the error expires, while Do still
+// does. On error, the values read so far are returned along with the error.
+//
+// Failed calls of fn are retried as set by WithRetries, and recorded by the
+// circuit breaker, once per batch rather than once per key, while hedged
+// fetches (see WithHedgeDelay) don't apply to DoMulti.
+//
+// NOTE: stale values and early expiration are not served by DoMulti, keys
+// past their TTL are fetched again.
+func (s *Stampede[V]) DoMulti(ctx context.Context, keys []string, fn func(missing []string) (map[string]V, error), options ...Option) (map[string]V, error) {
+	opts := s.callOptions(options...)
+	values := make(map[string]V, len(keys))
+	if s.lifecycle.isClosed() {
+		return values, ErrClosed
+	}
+
+	var firstErr error
+	var missing []string
+	seen := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		if !seen[key] {
+			seen[key] = true
+			missing = append(missing, key)
+		}
+	}
+
+	if !opts.SkipCache && s.cache != nil {
+		// read the local cache first, then the pending writes, then the
+		// cache store
+		var cacheKeys, misses []string
+		for _, key := range missing {
+			cacheKey := s.cacheKey(key)
+			e, ok := s.localCache().get(cacheKey)
+			if !ok {
+				e, ok = s.writes.get(cacheKey)
+			}
+			if ok && !e.isStale(time.Now()) {
+				s.observe().Hit(cacheKey)
+				values[key] = e.Value
+				continue
+			}
+			cacheKeys = append(cacheKeys, cacheKey)
+			misses = append(misses, key)
+		}
+		missing, misses = misses, nil
+		if len(missing) == 0 {
+			return values, nil
+		}
+
+		es, oks, err := s.batchGetEntries(ctx, cacheKeys)
+		if err != nil {
+			s.observe().Error("", err)
+			return values, err
+		}
+
+		now := time.Now()
+		for i, key := range missing {
+			if oks[i] && !es[i].isStale(now) {
+				s.observe().Hit(cacheKeys[i])
+				s.localCache().set(cacheKeys[i], es[i], es[i].FreshUntil.Sub(now))
+				values[key] = es[i].Value
+				continue
+			}
+			misses = append(misses, key)
+		}
+
+		// replay the recently failed fetches, instead of fetching the
+		// keys again
+		missing, misses = misses, nil
+		for _, key := range missing {
+			if err, ok := s.entries.getErr(s.cacheKey(key)); ok {
+				if err != ErrNotFound && firstErr == nil {
+					firstErr = err
+				}
+				continue
+			}
+			misses = append(misses, key)
+		}
+		missing = misses
+	}
+	if len(missing) == 0 {
+		return values, firstErr
+	}
+
+	// Keys already being fetched by another caller are left out of the
+	// batch, and their flights are joined below.
+	batch := &multiFetch[V]{inBatch: make(map[string]bool, len(missing))}
+	batch.call = func(ctx context.Context, keys []string) (map[string]V, map[string]bool, error) {
+		return s.callMulti(ctx, keys, fn, opts)
+	}
+	for _, key := range missing {
+		if !s.entries.isFetching(s.cacheKey(key)) {
+			batch.keys = append(batch.keys, key)
+			batch.inBatch[key] = true
+		}
+	}
+
+	// the calls of fn are retried, and recorded by the circuit breaker, by
+	// the batch rather than by the flight of each key
+	keyOpts := *opts
+	keyOpts.Retries = 0
+	keyOpts.HedgeDelay = 0
+	keyOpts.batched = true
+
+	waits := make([]*flightWait[V], len(missing))
+	for i, key := range missing {
+		cacheKey := s.cacheKey(key)
+		s.observe().Miss(cacheKey)
+		fetch := func(ctx context.Context) (V, *time.Duration, error) {
+			return batch.get(ctx, key)
+		}
+		waits[i] = s.startFlight(ctx, cacheKey, func(ctx context.Context) (doResult[V], error) {
+			if keyOpts.SkipCache || s.cache == nil {
+				return s.callFetch(ctx, cacheKey, fetch, &keyOpts)
+			}
+			return s.fetch(ctx, cacheKey, fetch, &keyOpts)
+		})
+	}
+
+	for i, key := range missing {
+		result, _, err := s.waitFlight(ctx, waits[i], opts)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		values[key] = result.Value
+	}
+	return values, firstErr
+}
+
+// multiFetch is the single call of the fetch function of DoMulti for a batch
+// of keys, shared by the flights of the keys.
+type multiFetch[V any] struct {
+	call    func(ctx context.Context, keys []string) (values map[string]V, open map[string]bool, err error)
+	keys    []string
+	inBatch map[string]bool
+
+	once   sync.Once
+	values map[string]V
+	open   map[string]bool
+	err    error
+}
+
+// get returns the value of key from the batch, calling the fetch function
+// on first use. The flight of a key outside the batch, which was expected
+// to be fetched by another caller, falls back to fetching the key alone.
+func (m *multiFetch[V]) get(ctx context.Context, key string) (V, *time.Duration, error) {
+	var values map[string]V
+	var open map[string]bool
+	var err error
+	if m.inBatch[key] {
+		m.once.Do(func() {
+			m.values, m.open, m.err = m.call(ctx, m.keys)
+		})
+		values, open, err = m.values, m.open, m.err
+	} else {
+		values, open, err = m.call(ctx, []string{key})
+	}
+
+	v, ok := values[key]
+	if open[key] {
+		return v, nil, ErrCircuitOpen
+	}
+	if err != nil {
+		return v, nil, err
+	}
+	if !ok {
+		return v, nil, ErrNotFound
+	}
+	return v, nil, nil
+}
+
+// callMulti calls the fetch function of DoMulti for a batch of keys,
+// retrying failed calls as set in opts, until ctx is done. The keys whose
+// circuit breaker is open are left out of the call, and are returned as
+// open. The outcome of the call is recorded once by the circuit breaker of
+// each group of the batch, so a single failed call doesn't count as one
+// failure per key.
+func (s *Stampede[V]) callMulti(ctx context.Context, keys []string, fn func(missing []string) (map[string]V, error), opts *Options) (values map[string]V, open map[string]bool, err error) {
+	if threshold := s.opts().CircuitBreakerThreshold; threshold > 0 {
+		allowed := make(map[string]bool)
+		var batch []string
+		for _, key := range keys {
+			group := s.circuitGroup(s.cacheKey(key))
+			ok, seen := allowed[group]
+			if !seen {
+				ok = s.circuits.allow(group)
+				allowed[group] = ok
+			}
+			if !ok {
+				if open == nil {
+					open = make(map[string]bool)
+				}
+				open[key] = true
+				continue
+			}
+			batch = append(batch, key)
+		}
+		if len(batch) == 0 {
+			return nil, open, ErrCircuitOpen
+		}
+		keys = batch
+		defer func() {
+			for group, ok := range allowed {
+				if ok {
+					s.circuits.done(group, err, threshold, s.opts().CircuitBreakerCooldown)
+				}
+			}
+		}()
+	}
+
+	backoff := retryBackoff(opts)
+	for retry := 0; ; retry++ {
+		values, err = callMultiFn(keys, fn)
+		if err == nil || retry >= opts.Retries || !retryable(err, opts) || !waitBackoff(ctx, backoff) {
+			return values, open, err
+		}
+		backoff *= 2
+	}
+}
+
+// callMultiFn calls the fetch function of DoMulti, recovering a panic into a
+// *PanicError. The panic is recovered here rather than by callFn, so every
+// key of the batch is failed with it.
+func callMultiFn[V any](keys []string, fn func(missing []string) (map[string]V, error)) (values map[string]V, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = newPanicError(r)
+		}
+	}()
+	return fn(keys)
+}
@@ -0,0 +1,102 @@
+package stampede
+
+import "time"
+
+// Observer receives the events of a stampede instance and of the HTTP
+// middleware, ie. to record metrics. See the prometheus subpackage for a
+// ready-made implementation. Observers are called inline, so they must be
+// safe for concurrent use and should not block. The key passed to the
+// observer is the namespaced cache key.
+type Observer interface {
+	// Hit is called when a fresh value is served from the cache.
+	Hit(key string)
+
+	// StaleHit is called when a stale value is served from the cache.
+	StaleHit(key string)
+
+	// Miss is called when a caller waits on a fetch, either its own or
+	// one shared with other callers.
+	Miss(key string)
+
+	// SharedWait is called when a caller was served the value of another
+	// caller's in-flight fetch.
+	SharedWait(key string)
+
+	// Fetch is called after each call of the fetch function, with its
+	// duration and error, if any.
+	Fetch(key string, duration time.Duration, err error)
+
+	// FailedWrite is called on failures to write a fetched value to the
+	// cache.
+	FailedWrite(key string, err error)
+
+	// DroppedWrite is called when a fetched value is not written to the
+	// cache because the write-behind queue is full, see WithWriteBehind.
+	DroppedWrite(key string)
+
+	// Error is called on failures to read from the cache, or to compute
+	// the cache key of a HTTP request. The key is empty when the error
+	// isn't specific to a single key.
+	Error(key string, err error)
+}
+
+// NoopObserver is an Observer which ignores all events.
+type NoopObserver struct{}
+
+var _ Observer = NoopObserver{}
+
+func (NoopObserver) Hit(key string)                                      {}
+func (NoopObserver) StaleHit(key string)                                 {}
+func (NoopObserver) Miss(key string)                                     {}
+func (NoopObserver) SharedWait(key string)                               {}
+func (NoopObserver) Fetch(key string, duration time.Duration, err error) {}
+func (NoopObserver) FailedWrite(key string, err error)                   {}
+func (NoopObserver) DroppedWrite(key string)                             {}
+func (NoopObserver) Error(key string, err error)                         {}
+
+// observerPair sends the events to both the stats of a stampede instance,
+// and to the Observer set in its options.
+type observerPair struct {
+	stats    *stats
+	observer Observer
+}
+
+func (o observerPair) Hit(key string) {
+	o.stats.Hit(key)
+	o.observer.Hit(key)
+}
+
+func (o observerPair) StaleHit(key string) {
+	o.stats.StaleHit(key)
+	o.observer.StaleHit(key)
+}
+
+func (o observerPair) Miss(key string) {
+	o.stats.Miss(key)
+	o.observer.Miss(key)
+}
+
+func (o observerPair) SharedWait(key string) {
+	o.stats.SharedWait(key)
+	o.observer.SharedWait(key)
+}
+
+func (o observerPair) Fetch(key string, duration time.Duration, err error) {
+	o.stats.Fetch(key, duration, err)
+	o.observer.Fetch(key, duration, err)
+}
+
+func (o observerPair) FailedWrite(key string, err error) {
+	o.stats.FailedWrite(key, err)
+	o.observer.FailedWrite(key, err)
+}
+
+func (o observerPair) DroppedWrite(key string) {
+	o.stats.DroppedWrite(key)
+	o.observer.DroppedWrite(key)
+}
+
+func (o observerPair) Error(key string, err error) {
+	o.stats.Error(key, err)
+	o.observer.Error(key, err)
+}
@@ -4,6 +4,12 @@ import (
 	"time"
 )
 
+// Options are the options of a stampede instance. The options passed to a
+// call of Do, or of its variants, apply over a copy of the options of the
+// instance for that call only. The options which set up the instance itself
+// are ignored when passed to a call, which are Namespace, KeyFunc, Observer,
+// Tracer, the circuit breaker, the local cache, the Locker, WriteBehind and
+// RefreshWorkers.
 type Options struct {
 	// TTL is the time-to-live for the cache. NOTE: if this is not set,
 	// then we use the package-level default of 1 minute. You can override
@@ -13,6 +19,21 @@ type Options struct {
 	// Default: 1 minute
 	TTL time.Duration
 
+	// TTLJitter randomly shortens the TTL of each cached entry by up to the
+	// given fraction of the TTL, ie. 0.1 for up to 10%, so entries cached at
+	// the same moment, ie. after a deploy, don't expire in lockstep. The
+	// jitter applies to TTLs returned by the fetch function and by
+	// HTTPStatusTTL as well, and never shortens a TTL by more than half.
+	//
+	// Default: 0 (disabled)
+	TTLJitter float64
+
+	// TTLJitterRange is like TTLJitter, but shortens the TTL by up to an
+	// absolute duration, and takes precedence over TTLJitter when set.
+	//
+	// Default: 0 (disabled)
+	TTLJitterRange time.Duration
+
 	// SkipCache is a flag that determines whether the cache should be skipped.
 	// If true, the cache will not be used, but the request will still use
 	// singleflight request coalescing.
@@ -20,6 +41,219 @@ type Options struct {
 	// Default: false
 	SkipCache bool
 
+	// Namespace is the namespace of cache keys, which allows several stampede
+	// instances, ie. of different services or value types, to safely share a
+	// single cache backend.
+	//
+	// Default: "stampede.v2"
+	Namespace string
+
+	// KeyFunc builds the cache key of key within namespace, to align cache
+	// keys with an existing naming scheme. Note that InvalidatePrefix expects
+	// KeyFunc to preserve key prefixes.
+	//
+	// Default: nil, which uses "<namespace>:<key>"
+	KeyFunc func(namespace, key string) string
+
+	// Observer receives the events of the stampede instance, ie. to record
+	// metrics of hits, misses, shared waits, fetch durations and errors.
+	//
+	// Default: nil
+	Observer Observer
+
+	// Tracer traces the phases of the calls of the stampede instance, ie.
+	// the cache lookups, the waits on flights and the fetches.
+	//
+	// Default: nil
+	Tracer Tracer
+
+	// StaleWhileRevalidate is the duration after the TTL has passed during
+	// which a stale value is still served to callers, while a single
+	// background refresh of the value takes place. This avoids the latency
+	// spike of callers blocking on the refresh every time an entry expires.
+	// The entry is kept in the cache for TTL + StaleWhileRevalidate.
+	//
+	// Default: 0 (disabled)
+	StaleWhileRevalidate time.Duration
+
+	// EarlyExpirationBeta enables probabilistic early expiration (XFetch).
+	// Each cache hit may trigger a background refresh of the entry before
+	// it expires, with a probability that grows as the expiry approaches
+	// and as the time it took to fetch the value increases. This spreads
+	// out the refreshes of keys that were written at the same moment.
+	// A beta of 1.0 is a good default, values above 1.0 favour earlier
+	// refreshes.
+	//
+	// Default: 0 (disabled)
+	EarlyExpirationBeta float64
+
+	// StaleIfError is the grace period after the TTL has passed during which
+	// a stale value is kept around, and served by Do if refreshing it fails.
+	// In that case Do returns the stale value along with a *StaleError which
+	// wraps the error of the refresh, so the caller may log it or annotate
+	// the response. The entry is kept in the cache for TTL + StaleIfError.
+	//
+	// Default: 0 (disabled)
+	StaleIfError time.Duration
+
+	// ErrorTTL is the time-to-live for errors returned by the fetch function.
+	// When set, a failed fetch is cached and the same error is replayed to
+	// callers for the ErrorTTL duration, instead of calling the fetch function
+	// again. This protects a failing upstream from being hammered.
+	//
+	// Default: 0 (errors are not cached)
+	ErrorTTL time.Duration
+
+	// ErrorFilter is a predicate which selects the errors to cache for
+	// ErrorTTL. If nil, all errors are cached.
+	//
+	// Default: nil
+	ErrorFilter func(err error) bool
+
+	// FetchTimeout bounds the duration of a single call of the fetch
+	// function, by way of the context passed to it (see DoCtx).
+	//
+	// Default: 0 (no timeout)
+	FetchTimeout time.Duration
+
+	// HedgeDelay enables hedged fetches: when the fetch function hasn't
+	// returned after HedgeDelay, it's called a second time, and the first
+	// successful call wins and is cached, while the other one is cancelled.
+	// This bounds the latency a single slow call inflicts on every caller
+	// waiting on it. The fetch function must be safe for concurrent use, and
+	// both calls are bounded by FetchTimeout. Hedged fetches don't apply to
+	// DoMulti.
+	//
+	// Default: 0 (disabled)
+	HedgeDelay time.Duration
+
+	// Retries is the number of times a failed call of the fetch function is
+	// retried, within the single flight of the key, so a single retry loop
+	// runs per key rather than one per caller. The retries are spaced out by
+	// an exponential backoff with jitter, and are bounded by the context of
+	// the fetch, ie. by FetchTimeout. Panics are not retried. The fetch
+	// function of DoMulti is retried once per batch of keys.
+	//
+	// Default: 0 (disabled)
+	Retries int
+
+	// RetryBackoff is the backoff before the first retry, which doubles on
+	// each following retry.
+	//
+	// Default: 100 milliseconds
+	RetryBackoff time.Duration
+
+	// RetryFilter is a predicate which selects the errors to retry, ie.
+	// transient errors. If nil, all errors are retried.
+	//
+	// Default: nil
+	RetryFilter func(err error) bool
+
+	// CircuitBreakerThreshold enables the circuit breaker, which opens after
+	// the given number of consecutive failed fetches of a key group. While
+	// open, fetches of the group are short-circuited with ErrCircuitOpen, or
+	// a stale value is served when there is one (see StaleIfError). After
+	// the CircuitBreakerCooldown, the breaker half-opens and lets a single
+	// fetch through to probe the upstream, which closes the breaker when it
+	// succeeds.
+	//
+	// Default: 0 (disabled)
+	CircuitBreakerThreshold int
+
+	// CircuitBreakerCooldown is how long an open circuit breaker
+	// short-circuits fetches before letting a probing fetch through.
+	//
+	// Default: 10 seconds
+	CircuitBreakerCooldown time.Duration
+
+	// CircuitBreakerGroup returns the group of a namespaced cache key, ie.
+	// the upstream it's fetched from, where each group has its own circuit
+	// breaker.
+	//
+	// Default: nil, where all keys share a single circuit breaker
+	CircuitBreakerGroup func(key string) string
+
+	// LocalCacheTTL enables a two-tier cache, with an in-process L1 cache in
+	// front of the cache store, ie. when the cache store is shared by many
+	// replicas. Values are read from the local cache first, then from the
+	// cache store, and fetched values are written to both. Values are kept
+	// in the local cache for LocalCacheTTL at most, which bounds how long a
+	// replica may serve a value invalidated by another replica, as
+	// invalidation only removes values from the local cache of the stampede
+	// instance it's called on.
+	//
+	// Default: 0 (disabled)
+	LocalCacheTTL time.Duration
+
+	// LocalCacheSize is the maximum number of entries of the local cache,
+	// past which the entries closest to their expiry are evicted. The local
+	// cache is split into shards, which each hold their share of the size,
+	// rounded up.
+	//
+	// Default: 10000
+	LocalCacheSize int
+
+	// Locker enables the coalescing of fetches across replicas sharing the
+	// cache store. Before fetching a key, a replica takes a lease on the key
+	// with the Locker, while the other replicas poll the cache store for the
+	// value, every LockPollInterval, instead of fetching it themselves. The
+	// lease is held until the value is written to the cache store, even with
+	// WriteBehind, and expires after LockTTL, so another replica takes over
+	// when the replica holding it dies. If the Locker fails, the key is
+	// fetched without coalescing across replicas. See StoreLocker for a
+	// Locker over the cache backend, and MemLocker for an in-process Locker.
+	//
+	// Default: nil
+	Locker Locker
+
+	// LockTTL is the TTL of the lease taken to fetch a key, which should be
+	// longer than the fetch.
+	//
+	// Default: 5 seconds
+	LockTTL time.Duration
+
+	// LockPollInterval is the interval at which the cache store is polled
+	// for the value of a key fetched by another replica.
+	//
+	// Default: 50 milliseconds
+	LockPollInterval time.Duration
+
+	// WriteBehind enables write-behind caching, with a queue of the given
+	// size. Fetched values are returned to the callers right away, while
+	// they are written to the cache in the background, so the latency of
+	// the cache backend is not added to every miss. Until the value is
+	// written, it's served to further calls for its key from the queue, by
+	// the stampede instance which fetched it. When the queue is full, the
+	// value is not cached, as reported by Observer.DroppedWrite.
+	// Close flushes the queue.
+	//
+	// Default: 0 (disabled)
+	WriteBehind int
+
+	// RefreshWorkers is the number of background workers refreshing the
+	// keys registered with RegisterRefresh.
+	//
+	// Default: 4
+	RefreshWorkers int
+
+	// Repanic re-panics in the caller whose fetch function panicked, with
+	// the *PanicError of the panic. Either way, the other callers waiting on
+	// the fetch receive the *PanicError as the error of Do.
+	//
+	// Default: false
+	Repanic bool
+
+	// Tags are the tags of the fetched values, along with the tags of the
+	// values which implement Tagger, so they may be removed from the cache
+	// together with InvalidateTag, ie. all the values of an account. The
+	// keys of each tag are indexed in the cache store, where the index is
+	// updated under a lease, so replicas don't overwrite each other's
+	// updates. The lease is taken with the Locker, if any, or else in the
+	// cache store, see StoreLocker.
+	//
+	// Default: nil
+	Tags []string
+
 	// HTTPCacheKeyRequestBody is a flag that determines whether the request body
 	// should be used to generate the cache key. This is useful for varying the cache
 	// key based on request headers.
@@ -40,6 +274,11 @@ type Options struct {
 	//
 	// Default: nil
 	HTTPStatusTTL func(status int) time.Duration
+
+	// batched is set on the options of the flights of the keys of a DoMulti
+	// batch, whose circuit breaker applies to the batch as a whole rather
+	// than to each key, see callMulti.
+	batched bool
 }
 
 // WithTTL sets the TTL for the cache.
@@ -51,6 +290,26 @@ func WithTTL(ttl time.Duration) Option {
 	}
 }
 
+// WithTTLJitter sets the TTLJitter, which randomly shortens the TTL of each
+// cached entry by up to the given fraction of the TTL, ie. 0.1 for 10%.
+//
+// Default: 0 (disabled)
+func WithTTLJitter(fraction float64) Option {
+	return func(o *Options) {
+		o.TTLJitter = fraction
+	}
+}
+
+// WithTTLJitterRange sets the TTLJitterRange, which randomly shortens the
+// TTL of each cached entry by up to d.
+//
+// Default: 0 (disabled)
+func WithTTLJitterRange(d time.Duration) Option {
+	return func(o *Options) {
+		o.TTLJitterRange = d
+	}
+}
+
 // WithSkipCache sets the SkipCache flag. If true, the cache will not be used,
 // but the request will still use singleflight request coalescing.
 //
@@ -61,6 +320,268 @@ func WithSkipCache(skip bool) Option {
 	}
 }
 
+// WithNamespace sets the Namespace of cache keys, so several stampede
+// instances may safely share a single cache backend.
+//
+// Default: "stampede"
+func WithNamespace(namespace string) Option {
+	return func(o *Options) {
+		o.Namespace = namespace
+	}
+}
+
+// WithKeyFunc sets the KeyFunc, which builds the cache key of key within
+// namespace.
+//
+// Default: nil, which uses "<namespace>:<key>"
+func WithKeyFunc(fn func(namespace, key string) string) Option {
+	return func(o *Options) {
+		o.KeyFunc = fn
+	}
+}
+
+// WithObserver sets the Observer, which receives the events of the stampede
+// instance, ie. to record metrics.
+//
+// Default: nil
+func WithObserver(observer Observer) Option {
+	return func(o *Options) {
+		o.Observer = observer
+	}
+}
+
+// WithTracer sets the Tracer, which traces the phases of the calls of the
+// stampede instance, ie. to record spans.
+//
+// Default: nil
+func WithTracer(tracer Tracer) Option {
+	return func(o *Options) {
+		o.Tracer = tracer
+	}
+}
+
+// WithStaleWhileRevalidate sets the StaleWhileRevalidate duration. Once the
+// TTL of an entry has passed, its stale value is served for up to d longer
+// while it's refreshed in the background.
+//
+// Default: 0 (disabled)
+func WithStaleWhileRevalidate(d time.Duration) Option {
+	return func(o *Options) {
+		o.StaleWhileRevalidate = d
+	}
+}
+
+// WithStaleIfError sets the StaleIfError grace period. Once the TTL of an
+// entry has passed, its stale value is served for up to d longer whenever
+// the refresh of the value fails.
+//
+// Default: 0 (disabled)
+func WithStaleIfError(d time.Duration) Option {
+	return func(o *Options) {
+		o.StaleIfError = d
+	}
+}
+
+// WithEarlyExpiration enables probabilistic early expiration (XFetch) with
+// the given beta. A beta of 1.0 is a good default, values above 1.0 favour
+// earlier refreshes.
+//
+// Default: 0 (disabled)
+func WithEarlyExpiration(beta float64) Option {
+	return func(o *Options) {
+		o.EarlyExpirationBeta = beta
+	}
+}
+
+// WithErrorTTL sets the ErrorTTL duration, which enables negative caching
+// of errors returned by the fetch function.
+//
+// Default: 0 (errors are not cached)
+func WithErrorTTL(ttl time.Duration) Option {
+	return func(o *Options) {
+		o.ErrorTTL = ttl
+	}
+}
+
+// WithErrorFilter sets the ErrorFilter predicate, to only cache selected
+// errors for ErrorTTL, ie. those which are not worth retrying right away.
+//
+// Default: nil
+func WithErrorFilter(fn func(err error) bool) Option {
+	return func(o *Options) {
+		o.ErrorFilter = fn
+	}
+}
+
+// WithFetchTimeout sets the FetchTimeout, which bounds the duration of a
+// single call of the fetch function passed to DoCtx.
+//
+// Default: 0 (no timeout)
+func WithFetchTimeout(d time.Duration) Option {
+	return func(o *Options) {
+		o.FetchTimeout = d
+	}
+}
+
+// WithHedgeDelay sets the HedgeDelay, after which a slow fetch function is
+// called a second time, and the first successful call wins.
+//
+// Default: 0 (disabled)
+func WithHedgeDelay(d time.Duration) Option {
+	return func(o *Options) {
+		o.HedgeDelay = d
+	}
+}
+
+// WithRetries sets the number of Retries of a failed call of the fetch
+// function, within the single flight of the key.
+//
+// Default: 0 (disabled)
+func WithRetries(retries int) Option {
+	return func(o *Options) {
+		o.Retries = retries
+	}
+}
+
+// WithRetryBackoff sets the RetryBackoff before the first retry, which
+// doubles on each following retry.
+//
+// Default: 100 milliseconds
+func WithRetryBackoff(d time.Duration) Option {
+	return func(o *Options) {
+		o.RetryBackoff = d
+	}
+}
+
+// WithRetryFilter sets the RetryFilter predicate, to only retry selected
+// errors, ie. transient errors.
+//
+// Default: nil
+func WithRetryFilter(fn func(err error) bool) Option {
+	return func(o *Options) {
+		o.RetryFilter = fn
+	}
+}
+
+// WithCircuitBreaker enables the circuit breaker, which opens after the
+// given number of consecutive failed fetches of a key group.
+//
+// Default: 0 (disabled)
+func WithCircuitBreaker(threshold int) Option {
+	return func(o *Options) {
+		o.CircuitBreakerThreshold = threshold
+	}
+}
+
+// WithCircuitBreakerCooldown sets the CircuitBreakerCooldown, during which
+// an open circuit breaker short-circuits fetches.
+//
+// Default: 10 seconds
+func WithCircuitBreakerCooldown(d time.Duration) Option {
+	return func(o *Options) {
+		o.CircuitBreakerCooldown = d
+	}
+}
+
+// WithCircuitBreakerGroup sets the CircuitBreakerGroup func, which returns
+// the group of a namespaced cache key, where each group has its own circuit
+// breaker.
+//
+// Default: nil, where all keys share a single circuit breaker
+func WithCircuitBreakerGroup(fn func(key string) string) Option {
+	return func(o *Options) {
+		o.CircuitBreakerGroup = fn
+	}
+}
+
+// WithLocalCache enables a two-tier cache, with an in-process L1 cache
+// holding values for up to ttl in front of the cache store.
+//
+// Default: 0 (disabled)
+func WithLocalCache(ttl time.Duration) Option {
+	return func(o *Options) {
+		o.LocalCacheTTL = ttl
+	}
+}
+
+// WithLocalCacheSize sets the LocalCacheSize, the maximum number of entries
+// of the local cache.
+//
+// Default: 10000
+func WithLocalCacheSize(size int) Option {
+	return func(o *Options) {
+		o.LocalCacheSize = size
+	}
+}
+
+// WithLocker sets the Locker, which enables the coalescing of fetches
+// across replicas sharing the cache store.
+//
+// Default: nil
+func WithLocker(locker Locker) Option {
+	return func(o *Options) {
+		o.Locker = locker
+	}
+}
+
+// WithLockTTL sets the LockTTL, the TTL of the lease taken to fetch a key.
+//
+// Default: 5 seconds
+func WithLockTTL(ttl time.Duration) Option {
+	return func(o *Options) {
+		o.LockTTL = ttl
+	}
+}
+
+// WithLockPollInterval sets the LockPollInterval, at which the cache store
+// is polled for the value of a key fetched by another replica.
+//
+// Default: 50 milliseconds
+func WithLockPollInterval(d time.Duration) Option {
+	return func(o *Options) {
+		o.LockPollInterval = d
+	}
+}
+
+// WithWriteBehind enables write-behind caching, where fetched values are
+// written to the cache on a background queue of the given size.
+//
+// Default: 0 (disabled)
+func WithWriteBehind(queueSize int) Option {
+	return func(o *Options) {
+		o.WriteBehind = queueSize
+	}
+}
+
+// WithRefreshWorkers sets the number of RefreshWorkers, which refresh the
+// keys registered with RegisterRefresh in the background.
+//
+// Default: 4
+func WithRefreshWorkers(n int) Option {
+	return func(o *Options) {
+		o.RefreshWorkers = n
+	}
+}
+
+// WithRepanic sets the Repanic flag, to re-panic in the caller whose fetch
+// function panicked, rather than returning the *PanicError of the panic.
+//
+// Default: false
+func WithRepanic(repanic bool) Option {
+	return func(o *Options) {
+		o.Repanic = repanic
+	}
+}
+
+// WithTags sets the Tags of the fetched values, see InvalidateTag.
+//
+// Default: nil
+func WithTags(tags ...string) Option {
+	return func(o *Options) {
+		o.Tags = tags
+	}
+}
+
 // WithHTTPStatusTTL sets the HTTPStatusTTL function. This allows you to
 // customize the TTL for different HTTP status codes.
 //
@@ -102,6 +623,7 @@ func getOptions(ttl time.Duration, options ...Option) *Options {
 	}
 	opts := &Options{
 		TTL:                        ttl,
+		Namespace:                  DefaultNamespace,
 		SkipCache:                  false,
 		HTTPStatusTTL:              nil,
 		HTTPCacheKeyRequestHeaders: nil,
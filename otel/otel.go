@@ -0,0 +1,195 @@
+// Package otel provides a stampede.Tracer which records the phases of the
+// calls of a stampede instance and of the HTTP middleware as OpenTelemetry
+// spans, along with wrappers of the stampede type and of its Handler.
+package otel
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/go-chi/stampede"
+	cachestore "github.com/goware/cachestore2"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ScopeName is the instrumentation scope name of the spans.
+const ScopeName = "github.com/go-chi/stampede/otel"
+
+// Attribute keys of the spans. Keys are recorded as a hash, so their
+// contents, ie. user ids, do not end up in the traces.
+const (
+	KeyHashKey = attribute.Key("stampede.key_hash")
+	HitKey     = attribute.Key("stampede.hit")
+	LeaderKey  = attribute.Key("stampede.leader")
+	WaitersKey = attribute.Key("stampede.waiters")
+	SourceKey  = attribute.Key("stampede.source")
+	SharedKey  = attribute.Key("stampede.shared")
+)
+
+// Tracer is a stampede.Tracer which records the cache lookups, the waits on
+// flights and the fetches as spans. The spans of callers which waited on the
+// fetch of another caller are linked to the span of that fetch.
+type Tracer struct {
+	tracer trace.Tracer
+}
+
+var _ stampede.Tracer = &Tracer{}
+
+// Option configures a Tracer.
+type Option func(*config)
+
+type config struct {
+	provider trace.TracerProvider
+}
+
+// WithTracerProvider sets the TracerProvider of the spans.
+//
+// Default: the global TracerProvider
+func WithTracerProvider(provider trace.TracerProvider) Option {
+	return func(c *config) {
+		c.provider = provider
+	}
+}
+
+// NewTracer returns a new Tracer, to pass to stampede.WithTracer.
+func NewTracer(options ...Option) *Tracer {
+	c := &config{}
+	for _, o := range options {
+		o(c)
+	}
+	if c.provider == nil {
+		c.provider = otel.GetTracerProvider()
+	}
+	return &Tracer{tracer: c.provider.Tracer(ScopeName)}
+}
+
+func (t *Tracer) Lookup(ctx context.Context, key string) (context.Context, func(hit bool, err error)) {
+	ctx, span := t.tracer.Start(ctx, "stampede.lookup", trace.WithAttributes(keyHash(key)))
+	return ctx, func(hit bool, err error) {
+		span.SetAttributes(HitKey.Bool(hit))
+		endSpan(span, err)
+	}
+}
+
+func (t *Tracer) Wait(ctx context.Context, key string) (context.Context, func(leader bool, fetch context.Context, err error)) {
+	ctx, span := t.tracer.Start(ctx, "stampede.wait", trace.WithAttributes(keyHash(key)))
+	return ctx, func(leader bool, fetch context.Context, err error) {
+		span.SetAttributes(LeaderKey.Bool(leader))
+		if !leader && fetch != nil {
+			// the fetch span is a child of the wait span of the leader, so
+			// the other callers are linked to it instead.
+			if sc := trace.SpanContextFromContext(fetch); sc.IsValid() {
+				span.AddLink(trace.Link{SpanContext: sc})
+			}
+		}
+		endSpan(span, err)
+	}
+}
+
+func (t *Tracer) Fetch(ctx context.Context, key string) (context.Context, func(waiters int, err error)) {
+	ctx, span := t.tracer.Start(ctx, "stampede.fetch", trace.WithAttributes(keyHash(key)))
+	return ctx, func(waiters int, err error) {
+		span.SetAttributes(WaitersKey.Int(waiters))
+		endSpan(span, err)
+	}
+}
+
+// Stampede wraps a stampede.Stampede, recording a span for each call along
+// with the spans of its Tracer.
+type Stampede[V any] struct {
+	*stampede.Stampede[V]
+	tracer *Tracer
+}
+
+var _ stampede.Doer[any] = &Stampede[any]{}
+
+// NewStampede returns a new stampede instance traced by tracer. If tracer is
+// nil, a Tracer using the global TracerProvider is used.
+func NewStampede[V any](logger *slog.Logger, cacheBackend cachestore.Backend, tracer *Tracer, options ...stampede.Option) *Stampede[V] {
+	if tracer == nil {
+		tracer = NewTracer()
+	}
+	options = append(slices.Clip(options), stampede.WithTracer(tracer))
+	return &Stampede[V]{
+		Stampede: stampede.NewStampede[V](logger, cacheBackend, options...),
+		tracer:   tracer,
+	}
+}
+
+func (s *Stampede[V]) Do(ctx context.Context, key string, fn func() (V, *time.Duration, error), options ...stampede.Option) (V, error) {
+	result, err := s.DoResult(ctx, key, func(context.Context) (V, *time.Duration, error) {
+		return fn()
+	}, options...)
+	return result.Value, err
+}
+
+func (s *Stampede[V]) DoCtx(ctx context.Context, key string, fn func(ctx context.Context) (V, *time.Duration, error), options ...stampede.Option) (V, error) {
+	result, err := s.DoResult(ctx, key, fn, options...)
+	return result.Value, err
+}
+
+func (s *Stampede[V]) DoResult(ctx context.Context, key string, fn func(ctx context.Context) (V, *time.Duration, error), options ...stampede.Option) (stampede.Result[V], error) {
+	ctx, span := s.tracer.tracer.Start(ctx, "stampede.Do")
+	result, err := s.Stampede.DoResult(ctx, key, fn, options...)
+	if err == nil {
+		span.SetAttributes(
+			SourceKey.String(result.Source.String()),
+			HitKey.Bool(result.Source == stampede.SourceCache || result.Source == stampede.SourceStale),
+			SharedKey.Bool(result.Shared),
+		)
+	}
+	endSpan(span, err)
+	return result, err
+}
+
+func (s *Stampede[V]) DoMulti(ctx context.Context, keys []string, fn func(missing []string) (map[string]V, error), options ...stampede.Option) (map[string]V, error) {
+	ctx, span := s.tracer.tracer.Start(ctx, "stampede.DoMulti", trace.WithAttributes(attribute.Int("stampede.keys", len(keys))))
+	values, err := s.Stampede.DoMulti(ctx, keys, fn, options...)
+	endSpan(span, err)
+	return values, err
+}
+
+// Handler is like stampede.Handler, but traced by tracer. Along with the
+// spans of the Tracer, it records a span for each request. If tracer is nil,
+// a Tracer using the global TracerProvider is used.
+func Handler(logger *slog.Logger, cacheBackend cachestore.Backend, ttl time.Duration, tracer *Tracer, options ...stampede.Option) func(next http.Handler) http.Handler {
+	return HandlerWithKey(logger, cacheBackend, ttl, nil, tracer, options...)
+}
+
+// HandlerWithKey is like stampede.HandlerWithKey, but traced by tracer, see
+// Handler.
+func HandlerWithKey(logger *slog.Logger, cacheBackend cachestore.Backend, ttl time.Duration, cacheKeyFunc stampede.CacheKeyFunc, tracer *Tracer, options ...stampede.Option) func(next http.Handler) http.Handler {
+	if tracer == nil {
+		tracer = NewTracer()
+	}
+	options = append(slices.Clip(options), stampede.WithTracer(tracer))
+	h := stampede.HandlerWithKey(logger, cacheBackend, ttl, cacheKeyFunc, options...)
+
+	return func(next http.Handler) http.Handler {
+		next = h(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, span := tracer.tracer.Start(r.Context(), "stampede.Handler")
+			defer span.End()
+			next.ServeHTTP(w, r.WithContext(ctx))
+			span.SetAttributes(HitKey.Bool(w.Header().Get("x-cache") == "hit"))
+		})
+	}
+}
+
+func keyHash(key string) attribute.KeyValue {
+	return KeyHashKey.Int64(int64(stampede.StringToHash(key)))
+}
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
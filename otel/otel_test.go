@@ -0,0 +1,100 @@
+package otel_test
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-chi/stampede"
+	"github.com/go-chi/stampede/otel"
+	"github.com/goware/cachestore2/noopcache"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestStampede(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	tracer := otel.NewTracer(otel.WithTracerProvider(provider))
+
+	s := otel.NewStampede[string](slog.Default(), noopcache.NewBackend(), tracer)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err := s.Do(context.Background(), "t1", func() (string, *time.Duration, error) {
+				time.Sleep(200 * time.Millisecond)
+				return "ok", nil, nil
+			})
+			assert.NoError(t, err)
+			assert.Equal(t, "ok", v)
+		}()
+	}
+	wg.Wait()
+
+	spans := map[string][]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = append(spans[span.Name()], span)
+	}
+	require.Len(t, spans["stampede.Do"], 3)
+	require.Len(t, spans["stampede.lookup"], 3)
+	require.Len(t, spans["stampede.wait"], 3)
+	require.Len(t, spans["stampede.fetch"], 1)
+
+	fetch := spans["stampede.fetch"][0]
+	assert.Contains(t, fetch.Attributes(), otel.WaitersKey.Int(3))
+
+	// the waiters are linked to the fetch span of the leader
+	var linked int
+	for _, wait := range spans["stampede.wait"] {
+		if wait.SpanContext().SpanID() == fetch.Parent().SpanID() {
+			assert.Contains(t, wait.Attributes(), otel.LeaderKey.Bool(true))
+			continue
+		}
+		assert.Contains(t, wait.Attributes(), otel.LeaderKey.Bool(false))
+		require.Len(t, wait.Links(), 1)
+		assert.Equal(t, fetch.SpanContext().SpanID(), wait.Links()[0].SpanContext.SpanID())
+		linked++
+	}
+	assert.Equal(t, 2, linked)
+
+	for _, lookup := range spans["stampede.lookup"] {
+		assert.Contains(t, lookup.Attributes(), otel.HitKey.Bool(false))
+	}
+}
+
+func TestHandler(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	tracer := otel.NewTracer(otel.WithTracerProvider(provider))
+
+	h := otel.Handler(slog.Default(), noopcache.NewBackend(), time.Minute, tracer, stampede.WithSkipCache(true))
+	srv := httptest.NewServer(h(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ok"))
+	})))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	names := map[string]int{}
+	for _, span := range recorder.Ended() {
+		names[span.Name()]++
+	}
+	assert.Equal(t, map[string]int{
+		"stampede.Handler": 1,
+		"stampede.wait":    1,
+		"stampede.fetch":   1,
+	}, names)
+}
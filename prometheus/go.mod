@@ -0,0 +1,34 @@
+module github.com/go-chi/stampede/prometheus
+
+go 1.23.0
+
+// The replace directive only applies when developing within this repo. The
+// required version is the first release of stampede with the Observer and
+// Tracer APIs, which this module depends on.
+replace github.com/go-chi/stampede => ../
+
+require (
+	github.com/go-chi/stampede v0.6.0
+	github.com/prometheus/client_golang v1.20.5
+	github.com/stretchr/testify v1.10.0
+)
+
+require (
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.3.0 // indirect
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/goware/cachestore2 v0.12.2 // indirect
+	github.com/goware/singleflight v0.3.0 // indirect
+	github.com/klauspost/cpuid/v2 v2.2.10 // indirect
+	github.com/kr/text v0.2.0 // indirect
+	github.com/kylelemons/godebug v1.1.0 // indirect
+	github.com/munnerz/goautoneg v0.0.0-20191010083416-a7dc8b61c822 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	github.com/prometheus/client_model v0.6.1 // indirect
+	github.com/prometheus/common v0.55.0 // indirect
+	github.com/prometheus/procfs v0.15.1 // indirect
+	github.com/zeebo/xxh3 v1.0.2 // indirect
+	golang.org/x/sys v0.32.0 // indirect
+	google.golang.org/protobuf v1.34.2 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
+)
@@ -0,0 +1,117 @@
+// Package prometheus provides a stampede.Observer which records the events
+// of a stampede instance and of the HTTP middleware as Prometheus metrics.
+package prometheus
+
+import (
+	"time"
+
+	"github.com/go-chi/stampede"
+	prom "github.com/prometheus/client_golang/prometheus"
+)
+
+// Observer is a stampede.Observer and a prometheus.Collector. Register it
+// with a Prometheus registry, and pass it to stampede.WithObserver.
+type Observer struct {
+	hits          prom.Counter
+	staleHits     prom.Counter
+	misses        prom.Counter
+	sharedWaits   prom.Counter
+	fetchDuration *prom.HistogramVec
+	failedWrites  prom.Counter
+	droppedWrites prom.Counter
+	errors        prom.Counter
+}
+
+var (
+	_ stampede.Observer = &Observer{}
+	_ prom.Collector    = &Observer{}
+)
+
+// NewObserver returns a new Observer, with its metrics labelled by name,
+// so several stampede instances can be registered on the same registry.
+func NewObserver(name string) *Observer {
+	labels := prom.Labels{"name": name}
+	counter := func(metric, help string) prom.Counter {
+		return prom.NewCounter(prom.CounterOpts{
+			Namespace:   "stampede",
+			Name:        metric,
+			Help:        help,
+			ConstLabels: labels,
+		})
+	}
+
+	return &Observer{
+		hits:        counter("hits_total", "Number of fresh values served from the cache."),
+		staleHits:   counter("stale_hits_total", "Number of stale values served from the cache."),
+		misses:      counter("misses_total", "Number of calls which waited on a fetch."),
+		sharedWaits: counter("shared_waits_total", "Number of calls served the value of another caller's fetch."),
+		fetchDuration: prom.NewHistogramVec(prom.HistogramOpts{
+			Namespace:   "stampede",
+			Name:        "fetch_duration_seconds",
+			Help:        "Duration of the calls of the fetch function.",
+			ConstLabels: labels,
+			Buckets:     prom.DefBuckets,
+		}, []string{"result"}),
+		failedWrites:  counter("failed_writes_total", "Number of failures to write a fetched value to the cache."),
+		droppedWrites: counter("dropped_writes_total", "Number of fetched values dropped by a full write-behind queue."),
+		errors:        counter("errors_total", "Number of failures to read from the cache."),
+	}
+}
+
+func (o *Observer) Hit(key string) {
+	o.hits.Inc()
+}
+
+func (o *Observer) StaleHit(key string) {
+	o.staleHits.Inc()
+}
+
+func (o *Observer) Miss(key string) {
+	o.misses.Inc()
+}
+
+func (o *Observer) SharedWait(key string) {
+	o.sharedWaits.Inc()
+}
+
+func (o *Observer) Fetch(key string, duration time.Duration, err error) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	o.fetchDuration.WithLabelValues(result).Observe(duration.Seconds())
+}
+
+func (o *Observer) FailedWrite(key string, err error) {
+	o.failedWrites.Inc()
+}
+
+func (o *Observer) DroppedWrite(key string) {
+	o.droppedWrites.Inc()
+}
+
+func (o *Observer) Error(key string, err error) {
+	o.errors.Inc()
+}
+
+func (o *Observer) Describe(ch chan<- *prom.Desc) {
+	o.hits.Describe(ch)
+	o.staleHits.Describe(ch)
+	o.misses.Describe(ch)
+	o.sharedWaits.Describe(ch)
+	o.fetchDuration.Describe(ch)
+	o.failedWrites.Describe(ch)
+	o.droppedWrites.Describe(ch)
+	o.errors.Describe(ch)
+}
+
+func (o *Observer) Collect(ch chan<- prom.Metric) {
+	o.hits.Collect(ch)
+	o.staleHits.Collect(ch)
+	o.misses.Collect(ch)
+	o.sharedWaits.Collect(ch)
+	o.fetchDuration.Collect(ch)
+	o.failedWrites.Collect(ch)
+	o.droppedWrites.Collect(ch)
+	o.errors.Collect(ch)
+}
@@ -0,0 +1,47 @@
+package prometheus_test
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/stampede"
+	"github.com/go-chi/stampede/prometheus"
+	prom "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestObserver(t *testing.T) {
+	observer := prometheus.NewObserver("test")
+	registry := prom.NewRegistry()
+	registry.MustRegister(observer)
+
+	s := stampede.NewStampede[string](slog.Default(), nil, stampede.WithObserver(observer))
+
+	ctx := context.Background()
+	_, err := s.Do(ctx, "t1", func() (string, *time.Duration, error) {
+		return "ok", nil, nil
+	})
+	require.NoError(t, err)
+	_, err = s.Do(ctx, "t2", func() (string, *time.Duration, error) {
+		return "", nil, errors.New("failed")
+	})
+	require.Error(t, err)
+
+	expected := `
+# HELP stampede_misses_total Number of calls which waited on a fetch.
+# TYPE stampede_misses_total counter
+stampede_misses_total{name="test"} 2
+`
+	err = testutil.GatherAndCompare(registry, strings.NewReader(expected), "stampede_misses_total")
+	require.NoError(t, err)
+
+	// one series of fetch durations for each result
+	count, err := testutil.GatherAndCount(registry, "stampede_fetch_duration_seconds")
+	require.NoError(t, err)
+	require.Equal(t, 2, count)
+}
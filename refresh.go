@@ -0,0 +1,165 @@
+package stampede
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// refresher refreshes the registered keys of a stampede instance ahead of
+// their expiry, on a pool of background workers. It's started on the first
+// registration.
+type refresher[V any] struct {
+	mu      sync.Mutex
+	keys    map[string]*refreshKey[V]
+	queue   chan *refreshKey[V]
+	stop    chan struct{}
+	workers sync.WaitGroup
+	closed  bool
+}
+
+// refreshKey is a key registered for refresh-ahead.
+type refreshKey[V any] struct {
+	key      string
+	fn       fetchFunc[V]
+	interval time.Duration
+	opts     *Options
+	timer    *time.Timer
+}
+
+// RegisterRefresh registers key to be refreshed ahead of its expiry, by
+// calling fn every interval on a background worker, so callers of Do never
+// see a miss. The first refresh happens right away. Refreshes share the
+// flight of the key with Do, so a caller of Do never triggers a second fetch
+// while the key is being refreshed, and the other way around. The interval
+// should be shorter than the TTL of the key. Registering a key again
+// replaces its previous registration.
+func (s *Stampede[V]) RegisterRefresh(key string, interval time.Duration, fn func(ctx context.Context) (V, *time.Duration, error), options ...Option) error {
+	opts := s.callOptions(options...)
+	if s.cache == nil || opts.SkipCache {
+		return errors.New("stampede: refresh-ahead requires a cache")
+	}
+	if interval <= 0 {
+		return errors.New("stampede: refresh interval must be positive")
+	}
+
+	r := &s.refresher
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return ErrClosed
+	}
+	if r.keys == nil {
+		s.startRefresher()
+	}
+
+	key = s.cacheKey(key)
+	if k, ok := r.keys[key]; ok {
+		k.timer.Stop()
+	}
+	k := &refreshKey[V]{key: key, fn: fn, interval: interval, opts: opts}
+	k.timer = time.AfterFunc(0, func() {
+		select {
+		case r.queue <- k:
+		case <-r.stop:
+		}
+	})
+	r.keys[key] = k
+	return nil
+}
+
+// UnregisterRefresh stops refreshing key ahead of its expiry.
+func (s *Stampede[V]) UnregisterRefresh(key string) {
+	r := &s.refresher
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key = s.cacheKey(key)
+	if k, ok := r.keys[key]; ok {
+		k.timer.Stop()
+		delete(r.keys, key)
+	}
+}
+
+// closeRefresher stops the refresh-ahead of the registered keys, and
+// returns a channel which is closed once the refreshes in progress are done.
+func (s *Stampede[V]) closeRefresher() <-chan struct{} {
+	r := &s.refresher
+	r.mu.Lock()
+	if !r.closed {
+		r.closed = true
+		for _, k := range r.keys {
+			k.timer.Stop()
+		}
+		if r.stop != nil {
+			close(r.stop)
+		}
+	}
+	r.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		r.workers.Wait()
+		close(done)
+	}()
+	return done
+}
+
+// startRefresher starts the workers of the refresher. Must be called with
+// s.refresher.mu held.
+func (s *Stampede[V]) startRefresher() {
+	r := &s.refresher
+	r.keys = make(map[string]*refreshKey[V])
+	r.queue = make(chan *refreshKey[V])
+	r.stop = make(chan struct{})
+
+	workers := s.opts().RefreshWorkers
+	if workers <= 0 {
+		workers = DefaultRefreshWorkers
+	}
+	r.workers.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer r.workers.Done()
+			for {
+				select {
+				case k := <-r.queue:
+					s.refresh(k)
+				case <-r.stop:
+					return
+				}
+			}
+		}()
+	}
+}
+
+// refresh refreshes a registered key, and schedules its next refresh.
+func (s *Stampede[V]) refresh(k *refreshKey[V]) {
+	r := &s.refresher
+	r.mu.Lock()
+	registered := r.keys[k.key] == k
+	r.mu.Unlock()
+	if !registered {
+		return
+	}
+
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				s.logger.Error("stampede: panic while refreshing value", "key", k.key, "err", r)
+			}
+		}()
+		_, _, err := s.flight(context.Background(), k.key, func(ctx context.Context) (doResult[V], error) {
+			return s.fetch(ctx, k.key, k.fn, k.opts)
+		}, k.opts)
+		if err != nil && err != ErrClosed {
+			s.logger.Warn("stampede: fail to refresh value", "key", k.key, "err", err)
+		}
+	}()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.keys[k.key] == k && !r.closed {
+		k.timer.Reset(k.interval)
+	}
+}
@@ -0,0 +1,82 @@
+package stampede
+
+import "time"
+
+// Source is where a value returned by DoResult came from.
+type Source int
+
+const (
+	// SourceCache is a fresh value read from the cache.
+	SourceCache Source = iota
+
+	// SourceStale is a stale value read from the cache, see
+	// WithStaleWhileRevalidate and WithStaleIfError.
+	SourceStale
+
+	// SourceFetch is a value fetched by the caller's own call of the
+	// fetch function, possibly shared with other callers.
+	SourceFetch
+
+	// SourceShared is a value fetched by another caller's in-flight call
+	// of the fetch function.
+	SourceShared
+)
+
+func (s Source) String() string {
+	switch s {
+	case SourceCache:
+		return "cache"
+	case SourceStale:
+		return "stale"
+	case SourceFetch:
+		return "fetch"
+	case SourceShared:
+		return "shared"
+	default:
+		return "unknown"
+	}
+}
+
+// Result is a value returned by DoResult, along with its metadata.
+type Result[V any] struct {
+	Value V
+
+	// Source is where the value came from.
+	Source Source
+
+	// Shared reports whether the fetch of the value was shared by several
+	// callers. Always false for values read from the cache.
+	Shared bool
+
+	// Age is the time since the value was fetched, if known.
+	Age time.Duration
+
+	// TTL is the remaining time until the value expires, which is negative
+	// for stale values. It is 0 if the value isn't cached.
+	TTL time.Duration
+}
+
+// cachedResult returns the result of a value read from the cache.
+func cachedResult[V any](e entry[V], source Source, now time.Time) Result[V] {
+	return Result[V]{
+		Value:  e.Value,
+		Source: source,
+		Age:    now.Sub(e.CreatedAt),
+		TTL:    e.FreshUntil.Sub(now),
+	}
+}
+
+// fetchedResult returns the result of a value fetched by a flight.
+func fetchedResult[V any](r doResult[V], leader, shared bool) Result[V] {
+	result := Result[V]{Value: r.Value, Source: SourceShared, Shared: shared}
+	if leader {
+		result.Source = SourceFetch
+	}
+	if !r.CreatedAt.IsZero() {
+		result.Age = time.Since(r.CreatedAt)
+	}
+	if r.TTL != nil && *r.TTL > 0 {
+		result.TTL = *r.TTL - result.Age
+	}
+	return result
+}
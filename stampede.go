@@ -4,7 +4,9 @@ import (
 	"context"
 	"fmt"
 	"log/slog"
-	"sync"
+	"math/rand/v2"
+	"slices"
+	"sync/atomic"
 	"time"
 
 	cachestore "github.com/goware/cachestore2"
@@ -17,112 +19,609 @@ const (
 	// you can pass WithTTL(d) to set your own ttl, or pass
 	// WithSkipCache() to disable caching
 	DefaultCacheTTL = 1 * time.Minute
+
+	// DefaultNamespace is the default namespace of cache keys. Pass
+	// WithNamespace(ns) to have several stampede instances safely share
+	// a single cache backend. It's versioned along with the format of the
+	// values in the cache backend, so values cached by older versions of
+	// stampede under "stampede:<key>" are left alone.
+	DefaultNamespace = "stampede.v2"
+
+	// DefaultRetryBackoff is the default backoff before the first retry of
+	// a failed fetch, when retries are enabled with WithRetries(n).
+	DefaultRetryBackoff = 100 * time.Millisecond
+
+	// DefaultCircuitBreakerCooldown is the default duration during which an
+	// open circuit breaker short-circuits fetches, see WithCircuitBreaker.
+	DefaultCircuitBreakerCooldown = 10 * time.Second
+
+	// DefaultRefreshWorkers is the default number of background workers
+	// refreshing the keys registered with RegisterRefresh.
+	DefaultRefreshWorkers = 4
+
+	// DefaultLocalCacheSize is the default maximum number of entries of the
+	// in-process L1 cache, see WithLocalCache.
+	DefaultLocalCacheSize = 10000
+
+	// DefaultLockTTL is the default TTL of the lease taken by a replica to
+	// fetch a key, see WithLocker.
+	DefaultLockTTL = 5 * time.Second
+
+	// DefaultLockPollInterval is the default interval at which replicas
+	// poll the cache for the value of a key fetched by another replica.
+	DefaultLockPollInterval = 50 * time.Millisecond
 )
 
-func NewStampede[V any](logger *slog.Logger, cache cachestore.Store[V], options ...Option) *stampede[V] {
+// NewStampede returns a new stampede instance caching values of type V in
+// cacheBackend, if any. Values are stored in an envelope along with their
+// freshness metadata, so several processes may share the cache backend.
+func NewStampede[V any](logger *slog.Logger, cacheBackend cachestore.Backend, options ...Option) *Stampede[V] {
 	opts := &Options{}
 	for _, o := range options {
 		o(opts)
 	}
 
-	return &stampede[V]{
+	var cache cachestore.Store[entry[V]]
+	var tags cachestore.Store[tagIndex]
+	var tagLocker Locker
+	if cacheBackend != nil {
+		cache = cachestore.OpenStore[entry[V]](cacheBackend)
+		tags = cachestore.OpenStore[tagIndex](cacheBackend)
+		tagLocker = NewStoreLocker(cacheBackend)
+	}
+
+	s := &Stampede[V]{
 		logger:    logger,
 		cache:     cache,
+		tags:      tags,
+		tagLocker: tagLocker,
 		callGroup: singleflight.Group[string, doResult[V]]{},
-		options:   opts,
+		entries:   newEntryTable(),
 	}
+	s.SetOptions(opts)
+	return s
+}
+
+// Doer is the interface implemented by Stampede, so services may depend on
+// an abstraction, wrap it, or substitute a fake in tests.
+type Doer[V any] interface {
+	Do(ctx context.Context, key string, fn func() (V, *time.Duration, error), options ...Option) (V, error)
+	DoCtx(ctx context.Context, key string, fn func(ctx context.Context) (V, *time.Duration, error), options ...Option) (V, error)
+	DoResult(ctx context.Context, key string, fn func(ctx context.Context) (V, *time.Duration, error), options ...Option) (Result[V], error)
+	DoMulti(ctx context.Context, keys []string, fn func(missing []string) (map[string]V, error), options ...Option) (map[string]V, error)
+	Forget(key string)
+	Invalidate(ctx context.Context, keys ...string) error
+	InvalidatePrefix(ctx context.Context, prefix string) error
+	InvalidateTag(ctx context.Context, tag string) error
+	Stats() Stats
+}
+
+// Tagger is implemented by fetched values which tag their own cache entry,
+// along with the tags of WithTags, see InvalidateTag.
+type Tagger interface {
+	CacheTags() []string
 }
 
-type stampede[V any] struct {
+var _ Doer[any] = &Stampede[any]{}
+
+// Stampede coalesces concurrent fetches of the same key into a single call,
+// and caches the fetched values in the cache store, if any.
+type Stampede[V any] struct {
 	logger    *slog.Logger
-	cache     cachestore.Store[V]
+	cache     cachestore.Store[entry[V]]
+	tags      cachestore.Store[tagIndex]
+	local     atomic.Pointer[localCache[entry[V]]]
 	callGroup singleflight.Group[string, doResult[V]]
-	options   *Options
-	mu        sync.RWMutex
+	options   atomic.Pointer[Options]
+	entries   *entryTable
+	stats     stats
+	waiters   waiterCount
+	circuits  circuitBreakers
+	refresher refresher[V]
+	lifecycle lifecycle
+	keyLocks  keyLocks
+	tagLocks  keyLocks
+	tagLocker Locker
+	writes    writeQueue[V]
 }
 
 type doResult[V any] struct {
-	Value V
-	TTL   *time.Duration
+	Value     V
+	TTL       *time.Duration
+	CreatedAt time.Time
+
+	// traceCtx is the context of the fetch, for the Tracer.
+	traceCtx context.Context
 }
 
-func (s *stampede[V]) Do(ctx context.Context, key string, fn func() (V, *time.Duration, error), options ...Option) (V, error) {
-	var opts *Options
-	if len(options) > 0 {
-		opts = getOptions(0, options...)
-	} else {
-		opts = s.options
+// Do returns the value for key, calling fn to fetch it on a cache miss.
+// Concurrent calls for the same key share a single call of fn. A caller
+// stops waiting and returns ctx.Err() as soon as its own ctx is cancelled,
+// while the shared call of fn carries on for the remaining callers.
+func (s *Stampede[V]) Do(ctx context.Context, key string, fn func() (V, *time.Duration, error), options ...Option) (V, error) {
+	result, err := s.do(ctx, key, func(context.Context) (V, *time.Duration, error) {
+		return fn()
+	}, options...)
+	return result.Value, err
+}
+
+// DoCtx is like Do, but fn receives a context carrying the values of ctx,
+// which is cancelled only once every caller waiting on the shared fetch has
+// gone away, or when the fetch timeout fires (see WithFetchTimeout).
+func (s *Stampede[V]) DoCtx(ctx context.Context, key string, fn func(ctx context.Context) (V, *time.Duration, error), options ...Option) (V, error) {
+	result, err := s.do(ctx, key, fn, options...)
+	return result.Value, err
+}
+
+// DoResult is like DoCtx, but returns the value along with its metadata,
+// ie. whether it came from the cache or from a fetch, its age and TTL.
+func (s *Stampede[V]) DoResult(ctx context.Context, key string, fn func(ctx context.Context) (V, *time.Duration, error), options ...Option) (Result[V], error) {
+	return s.do(ctx, key, fn, options...)
+}
+
+func (s *Stampede[V]) do(ctx context.Context, key string, fn fetchFunc[V], options ...Option) (Result[V], error) {
+	if s.lifecycle.isClosed() {
+		return Result[V]{}, ErrClosed
 	}
+	opts := s.callOptions(options...)
+	key = s.cacheKey(key)
 
-	key = fmt.Sprintf("stampede:%s", key)
+	// leader is set when the fetch of this caller is the one being run
+	// by the flight, rather than the fetch of another caller
+	var leader bool
 
 	if opts.SkipCache || s.cache == nil {
 		// Singleflight mode only
-		result, err, _ := s.callGroup.Do(key, func() (doResult[V], error) {
-			v, ttl, err := fn()
-			if err != nil {
-				return doResult[V]{Value: v, TTL: ttl}, err
-			}
-			return doResult[V]{Value: v, TTL: ttl}, nil
-		})
-		return result.Value, err
+		s.observe().Miss(key)
+		result, shared, err := s.flight(ctx, key, func(ctx context.Context) (doResult[V], error) {
+			leader = true
+			return s.callFetch(ctx, key, fn, opts)
+		}, opts)
+		if err != nil && ctx.Err() != nil {
+			// the caller has gone away
+			return Result[V]{Value: result.Value}, err
+		}
+		if !leader {
+			s.observe().SharedWait(key)
+		}
+		return fetchedResult(result, leader, shared), err
 
 	} else {
 		// Caching + Singleflight combo mode
-		s.mu.RLock()
-		v, ok, err := s.cache.Get(ctx, key)
+		// read the local cache first, then the pending writes, then the
+		// cache store
+		lookupCtx, endLookup := s.tracer().Lookup(ctx, key)
+		e, local := s.localCache().get(key)
+		if !local {
+			e, local = s.writes.get(key)
+		}
+		ok := local
+		var err error
+		if !local {
+			e, ok, err = s.getEntry(lookupCtx, key)
+		}
+		endLookup(ok, err)
 		if err != nil {
-			s.mu.RUnlock()
-			return v, err
+			s.observe().Error(key, err)
+			return Result[V]{Value: e.Value}, err
 		}
-		s.mu.RUnlock()
+		// stale value which may be served if the refresh fails
+		var stale *Result[V]
+
 		if ok {
-			// cache hit
-			return v, nil
+			now := time.Now()
+			if !e.isStale(now) {
+				// cache hit, which may be probabilistically recomputed
+				// ahead of its expiry
+				if e.expireEarly(now, opts.EarlyExpirationBeta) {
+					s.revalidate(ctx, key, fn, opts)
+				}
+				if !local {
+					s.localCache().set(key, e, e.FreshUntil.Sub(now))
+				}
+				s.observe().Hit(key)
+				return cachedResult(e, SourceCache, now), nil
+			}
+			if e.staleFor(now) <= opts.StaleWhileRevalidate {
+				// stale hit, serve the stale value while refreshing in the background
+				s.revalidate(ctx, key, fn, opts)
+				s.observe().StaleHit(key)
+				return cachedResult(e, SourceStale, now), nil
+			}
+			if e.staleFor(now) <= opts.StaleIfError {
+				result := cachedResult(e, SourceStale, now)
+				stale = &result
+			}
 		}
 
-		result, err, _ := s.callGroup.Do(key, func() (doResult[V], error) {
-			v, ttl, err := fn()
-			if err != nil {
-				return doResult[V]{Value: v, TTL: ttl}, err
+		// replay a recently failed fetch, instead of calling fn again. A
+		// key missing from the fetch of DoMulti may still be found by fn.
+		if err, ok := s.entries.getErr(key); ok && err != ErrNotFound {
+			return s.staleOrError(key, stale, err)
+		}
+
+		s.observe().Miss(key)
+		result, shared, err := s.flight(ctx, key, func(ctx context.Context) (doResult[V], error) {
+			leader = true
+			return s.fetch(ctx, key, fn, opts)
+		}, opts)
+		if err != nil {
+			if ctx.Err() != nil {
+				// the caller has gone away
+				return Result[V]{Value: result.Value}, err
 			}
-			return doResult[V]{Value: v, TTL: ttl}, nil
-		})
+			return s.staleOrError(key, stale, err)
+		}
+		if !leader {
+			s.observe().SharedWait(key)
+		}
+		return fetchedResult(result, leader, shared), nil
+	}
+}
+
+// staleOrError returns the stale value along with a *StaleError wrapping
+// err, or just err if there is no stale value to fall back to.
+func (s *Stampede[V]) staleOrError(key string, stale *Result[V], err error) (Result[V], error) {
+	if stale == nil {
+		return Result[V]{}, err
+	}
+	s.observe().StaleHit(key)
+	return *stale, &StaleError{Err: err, StaleFor: -stale.TTL}
+}
 
+// fetch calls fn and caches its result. It must be called from within the
+// callGroup, so only a single fetch per key is running at any time.
+func (s *Stampede[V]) fetch(ctx context.Context, key string, fn fetchFunc[V], opts *Options) (doResult[V], error) {
+	// release releases the lease of key, once the fetched value is cached
+	var release func()
+	if s.opts().Locker != nil {
+		// coalesce the fetch across replicas
+		var e entry[V]
+		var found bool
+		var err error
+		release, e, found, err = s.lease(ctx, key)
 		if err != nil {
-			return result.Value, err
+			return doResult[V]{}, err
+		}
+		if found {
+			s.localCache().set(key, e, time.Until(e.FreshUntil))
+			ttl := e.FreshUntil.Sub(e.CreatedAt)
+			return doResult[V]{Value: e.Value, TTL: &ttl, CreatedAt: e.CreatedAt}, nil
 		}
+		defer func() {
+			if release != nil {
+				release()
+			}
+		}()
+	}
 
-		var ttl time.Duration
-		if result.TTL != nil {
-			ttl = *result.TTL
-		} else {
-			ttl = opts.TTL
+	fetchID := s.entries.beginFetch(key)
+	result, err := s.callFetch(ctx, key, fn, opts)
+	delta := time.Since(result.CreatedAt)
+
+	var w cacheWrite[V]
+	if err == nil {
+		w = s.newCacheWrite(ctx, key, result, delta, opts)
+		result.TTL = &w.entryTTL
+		if w.ttl > 0 && len(w.tags) > 0 && s.opts().WriteBehind == 0 {
+			// the key is indexed before taking its lock, as the index of a
+			// tag may be held by another replica. The write-behind worker
+			// indexes the values it writes.
+			s.indexTags(w.ctx, key, w.tags, time.Now().Add(w.ttl))
 		}
+	}
 
-		// if ttl is 0, don't cache the result
-		if ttl == 0 {
-			return result.Value, nil
+	// the result is cached under the lock of the key, so an invalidation of
+	// the key happens either before, and the result is not cached, or after,
+	// and the cached result is removed.
+	mu := s.keyLocks.lock(key)
+	defer mu.Unlock()
+	if !s.entries.endFetch(key, fetchID) {
+		// the key was forgotten or invalidated while fetching, so the
+		// result is handed to the callers waiting on it, but not cached.
+		return result, err
+	}
+	if err != nil {
+		// negative caching of the error, if enabled, unless the fetch was
+		// cancelled as all of its callers have gone away, which says
+		// nothing about the upstream.
+		if opts.ErrorTTL > 0 && ctx.Err() == nil && err != ErrCircuitOpen && (opts.ErrorFilter == nil || opts.ErrorFilter(err)) {
+			s.entries.setErr(key, err, opts.ErrorTTL)
 		}
+		return result, err
+	}
 
-		// cache the result
-		s.mu.Lock()
-		err = s.cache.SetEx(ctx, key, result.Value, ttl)
+	// if ttl is 0, don't cache the result
+	if w.ttl == 0 {
+		return result, nil
+	}
+
+	s.localCache().set(key, w.entry, w.entryTTL)
+	if s.opts().WriteBehind > 0 {
+		// the lease is held until the value is written
+		w.release, release = release, nil
+		s.enqueueWrite(w)
+	} else {
+		s.writeCache(w)
+	}
+	return result, nil
+}
+
+// newCacheWrite returns the write of a fetched result to the cache. The
+// value is cached for the TTL of the result, or else of opts, and kept
+// around for a little longer when stale values may be served. The write is
+// not bound to the callers waiting on the fetch, so the value is cached even
+// when all of them have gone away in the meantime.
+func (s *Stampede[V]) newCacheWrite(ctx context.Context, key string, result doResult[V], delta time.Duration, opts *Options) cacheWrite[V] {
+	var cacheTTL time.Duration
+	if result.TTL != nil {
+		cacheTTL = *result.TTL
+	} else {
+		cacheTTL = opts.TTL
+	}
+	cacheTTL = jitterTTL(cacheTTL, opts)
+
+	w := cacheWrite[V]{
+		ctx:      context.WithoutCancel(ctx),
+		key:      key,
+		entryTTL: cacheTTL,
+	}
+	if cacheTTL == 0 {
+		return w
+	}
+	w.entry = newEntry(result.Value, result.CreatedAt, delta, cacheTTL)
+	w.ttl = cacheTTL + max(opts.StaleWhileRevalidate, opts.StaleIfError)
+	w.tags = cacheTags(result.Value, opts)
+	return w
+}
+
+// writeCache writes a fetched value to the cache, in its envelope along with
+// its metadata. The key must already be in the index of the tags of the
+// value, see indexTags. Errors are logged, and the value is still returned
+// to the callers.
+func (s *Stampede[V]) writeCache(w cacheWrite[V]) {
+	err := s.cache.SetEx(w.ctx, w.key, w.entry, w.ttl)
+	if err != nil {
+		s.logger.Error("stampede: fail to set cache value", "err", err)
+		s.observe().FailedWrite(w.key, err)
+		return
+	}
+	s.entries.set(w.key)
+}
+
+// cacheTags returns the tags of a fetched value, which are the tags of opts
+// along with the tags of the value itself, if it's a Tagger.
+func cacheTags[V any](value V, opts *Options) []string {
+	tags := opts.Tags
+	if t, ok := any(value).(Tagger); ok {
+		tags = append(slices.Clip(tags), t.CacheTags()...)
+	}
+	return tags
+}
+
+// jitterTTL randomly shortens ttl by up to the TTL jitter of opts, so entries
+// cached at the same moment don't expire in lockstep.
+func jitterTTL(ttl time.Duration, opts *Options) time.Duration {
+	if ttl <= 0 {
+		return ttl
+	}
+	jitter := opts.TTLJitterRange
+	if jitter <= 0 {
+		jitter = time.Duration(float64(ttl) * opts.TTLJitter)
+	}
+	// keep at least half of the ttl, so the entry is still worth caching
+	jitter = min(jitter, ttl/2)
+	if jitter <= 0 {
+		return ttl
+	}
+	return ttl - rand.N(jitter+1)
+}
+
+// revalidate refreshes a stale or early expired key in the background. Only a single
+// background refresh is started per key, and it shares the callGroup
+// with regular fetches of the same key.
+func (s *Stampede[V]) revalidate(ctx context.Context, key string, fn fetchFunc[V], opts *Options) {
+	if err, ok := s.entries.getErr(key); ok && err != ErrNotFound {
+		// upstream is failing, hold off refreshing until the error expires
+		return
+	}
+	if !s.lifecycle.add() {
+		return
+	}
+	if !s.entries.startRefresh(key) {
+		s.lifecycle.done()
+		return
+	}
+	ctx = context.WithoutCancel(ctx)
+	go func() {
+		defer s.lifecycle.done()
+		defer s.entries.endRefresh(key)
+		defer func() {
+			if r := recover(); r != nil {
+				s.logger.Error("stampede: panic while revalidating stale value", "key", key, "err", r)
+			}
+		}()
+		_, _, err := s.flight(ctx, key, func(ctx context.Context) (doResult[V], error) {
+			return s.fetch(ctx, key, fn, opts)
+		}, opts)
+		if err != nil && err != ErrClosed {
+			s.logger.Warn("stampede: fail to revalidate stale value", "key", key, "err", err)
+		}
+	}()
+}
+
+// Forget forgets the in-flight fetch of key, if any, so the next call for
+// key starts a new fetch instead of waiting on it. Callers already waiting
+// on the forgotten fetch still receive its result, but it is not cached.
+func (s *Stampede[V]) Forget(key string) {
+	key = s.cacheKey(key)
+	s.entries.forget(key)
+	s.writes.forget(key)
+	s.callGroup.Forget(key)
+}
+
+// Invalidate removes the given keys from the cache, along with any cached
+// error, and forgets their in-flight fetches.
+func (s *Stampede[V]) Invalidate(ctx context.Context, keys ...string) error {
+	for _, key := range keys {
+		if err := s.invalidate(ctx, s.cacheKey(key)); err != nil {
+			return fmt.Errorf("stampede: fail to invalidate key: %w", err)
+		}
+	}
+	return nil
+}
+
+func (s *Stampede[V]) invalidate(ctx context.Context, key string) error {
+	mu := s.keyLocks.lock(key)
+	defer mu.Unlock()
+	return s.deleteKey(ctx, key)
+}
+
+// deleteKey removes key from the cache, along with any cached error, and
+// forgets its in-flight fetch. It must be called with the lock of the key
+// held.
+func (s *Stampede[V]) deleteKey(ctx context.Context, key string) error {
+	s.entries.forget(key)
+	s.writes.forget(key)
+	s.callGroup.Forget(key)
+	s.entries.delete(key)
+	s.localCache().delete(key)
+	if s.cache == nil {
+		return nil
+	}
+	return s.cache.Delete(ctx, key)
+}
+
+// InvalidatePrefix removes all keys with the given prefix from the cache,
+// along with any cached error, and forgets their in-flight fetches.
+func (s *Stampede[V]) InvalidatePrefix(ctx context.Context, prefix string) error {
+	prefix = s.cacheKey(prefix)
+	s.keyLocks.lockAll()
+	defer s.keyLocks.unlockAll()
+	for _, key := range s.entries.forgetPrefix(prefix) {
+		s.callGroup.Forget(key)
+	}
+	s.writes.forgetPrefix(prefix)
+	s.entries.deletePrefix(prefix)
+	s.localCache().deletePrefix(prefix)
+	if s.cache == nil {
+		return nil
+	}
+	if err := s.cache.DeletePrefix(ctx, prefix); err != nil {
+		return fmt.Errorf("stampede: fail to invalidate key prefix: %w", err)
+	}
+	return nil
+}
+
+// InvalidateTag removes all keys whose value was cached with tag from the
+// cache, see WithTags and Tagger, along with the pending writes of such
+// values. The keys of a tag are indexed in the cache store under the
+// namespace, and the index is updated under a lease, so the keys cached by
+// any replica sharing the cache store are removed.
+func (s *Stampede[V]) InvalidateTag(ctx context.Context, tag string) error {
+	keys := s.writes.tagged(tag)
+	var idx tagIndex
+	if s.tags != nil {
+		var err error
+		idx, _, err = s.tags.Get(ctx, s.tagKey(tag))
 		if err != nil {
-			s.mu.Unlock()
-			// We log the error here and return the result.Value
-			s.logger.Error("stampede: fail to set cache value", "err", err)
-			return result.Value, nil
+			return fmt.Errorf("stampede: fail to invalidate tag: %w", err)
+		}
+		for key := range idx.Keys {
+			keys = append(keys, key)
+		}
+	}
+	for _, key := range keys {
+		if err := s.invalidate(ctx, key); err != nil {
+			return fmt.Errorf("stampede: fail to invalidate tag: %w", err)
+		}
+	}
+	if len(idx.Keys) == 0 {
+		return nil
+	}
+
+	// drop the removed keys from the index, unless they were cached again
+	// in the meantime
+	err := s.updateTagIndex(ctx, tag, func(keys map[string]time.Time) {
+		for key, expiresAt := range idx.Keys {
+			if keys[key].Equal(expiresAt) {
+				delete(keys, key)
+			}
 		}
-		s.mu.Unlock()
-		return result.Value, nil
+	})
+	if err != nil {
+		return fmt.Errorf("stampede: fail to invalidate tag: %w", err)
+	}
+	return nil
+}
+
+// observe returns the Observer of the events of the stampede instance,
+// which keeps its stats and forwards to the Observer of its options.
+func (s *Stampede[V]) observe() Observer {
+	if s.opts().Observer == nil {
+		return &s.stats
 	}
+	return observerPair{stats: &s.stats, observer: s.opts().Observer}
+}
+
+// tracer returns the Tracer of the stampede instance.
+func (s *Stampede[V]) tracer() Tracer {
+	if s.opts().Tracer == nil {
+		return noopTracer{}
+	}
+	return s.opts().Tracer
+}
+
+// callOptions returns the options of a call, which are the options passed to
+// the call applied over a copy of the options of the stampede instance.
+func (s *Stampede[V]) callOptions(options ...Option) *Options {
+	if len(options) == 0 {
+		return s.opts()
+	}
+	opts := *s.opts()
+	for _, o := range options {
+		o(&opts)
+	}
+	if opts.TTL == 0 {
+		opts.TTL = DefaultCacheTTL
+	}
+	return &opts
+}
+
+// cacheKey returns the namespaced key used in the callGroup and cache.
+func (s *Stampede[V]) cacheKey(key string) string {
+	namespace := s.opts().Namespace
+	if namespace == "" {
+		namespace = DefaultNamespace
+	}
+	if s.opts().KeyFunc != nil {
+		return s.opts().KeyFunc(namespace, key)
+	}
+	return fmt.Sprintf("%s:%s", namespace, key)
+}
+
+// Stats returns a snapshot of the counters of the stampede instance.
+func (s *Stampede[V]) Stats() Stats {
+	return s.stats.snapshot()
+}
+
+// SetOptions replaces the options of the stampede instance. It's safe to
+// call while the instance is in use, and applies to the calls made
+// afterwards. The local cache is reset when the options are replaced.
+func (s *Stampede[V]) SetOptions(options *Options) {
+	s.local.Store(newLocalCache[entry[V]](options))
+	s.options.Store(options)
+}
+
+// opts returns the options of the stampede instance, see SetOptions.
+func (s *Stampede[V]) opts() *Options {
+	return s.options.Load()
 }
 
-func (s *stampede[V]) SetOptions(options *Options) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	s.options = options
+// localCache returns the local cache of the stampede instance, or nil if
+// disabled.
+func (s *Stampede[V]) localCache() *localCache[entry[V]] {
+	return s.local.Load()
 }
 
 func BytesToHash(b ...[]byte) uint64 {
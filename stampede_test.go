@@ -2,6 +2,7 @@ package stampede_test
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"runtime"
@@ -12,6 +13,7 @@ import (
 	"time"
 
 	"github.com/go-chi/stampede"
+	memcache "github.com/goware/cachestore-mem"
 	cachestore "github.com/goware/cachestore2"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -60,7 +62,7 @@ func TestSingleflightDo(t *testing.T) {
 
 func TestCachedDo(t *testing.T) {
 	var count uint64
-	stampede := stampede.NewStampede(slog.Default(), newMockCacheBackend(), stampede.WithTTL(5*time.Second))
+	stampede := stampede.NewStampede[any](slog.Default(), newMockCacheBackend(), stampede.WithTTL(5*time.Second))
 
 	// repeat test multiple times
 	for x := 0; x < 5; x++ {
@@ -102,6 +104,1596 @@ func TestCachedDo(t *testing.T) {
 	}
 }
 
+func TestStaleWhileRevalidate(t *testing.T) {
+	var numCalls atomic.Int64
+	s := stampede.NewStampede[any](slog.Default(), newMockCacheBackend(),
+		stampede.WithTTL(100*time.Millisecond),
+		stampede.WithStaleWhileRevalidate(5*time.Second),
+	)
+
+	fn := func() (any, *time.Duration, error) {
+		n := numCalls.Add(1)
+		time.Sleep(200 * time.Millisecond)
+		return n, nil, nil
+	}
+
+	ctx := context.Background()
+
+	v, err := s.Do(ctx, "t1", fn)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), v)
+
+	// let the value go stale
+	time.Sleep(150 * time.Millisecond)
+
+	// stale value is served right away, while a single refresh runs in the background
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start := time.Now()
+			v, err := s.Do(ctx, "t1", fn)
+			assert.NoError(t, err)
+			assert.Equal(t, int64(1), v)
+			assert.Less(t, time.Since(start), 100*time.Millisecond)
+		}()
+	}
+	wg.Wait()
+
+	// wait for the background refresh to complete
+	time.Sleep(300 * time.Millisecond)
+
+	v, err = s.Do(ctx, "t1", fn)
+	require.NoError(t, err)
+	require.Equal(t, int64(2), v)
+	require.Equal(t, int64(2), numCalls.Load())
+}
+
+func TestStaleWhileRevalidateSharedBackend(t *testing.T) {
+	// the freshness of a value is stored along with it, so a replica, or a
+	// restarted process, sharing the cache backend knows it's stale
+	backend := newMockCacheBackend()
+	options := []stampede.Option{
+		stampede.WithTTL(100 * time.Millisecond),
+		stampede.WithStaleWhileRevalidate(5 * time.Second),
+	}
+	s1 := stampede.NewStampede[any](slog.Default(), backend, options...)
+	s2 := stampede.NewStampede[any](slog.Default(), backend, options...)
+
+	var numCalls atomic.Int64
+	fn := func(ctx context.Context) (any, *time.Duration, error) {
+		return numCalls.Add(1), nil, nil
+	}
+
+	ctx := context.Background()
+	_, err := s1.DoResult(ctx, "t1", fn)
+	require.NoError(t, err)
+
+	result, err := s2.DoResult(ctx, "t1", fn)
+	require.NoError(t, err)
+	require.Equal(t, stampede.SourceCache, result.Source)
+	require.Greater(t, result.TTL, time.Duration(0))
+
+	// let the value go stale, which s2 refreshes in the background
+	time.Sleep(150 * time.Millisecond)
+	result, err = s2.DoResult(ctx, "t1", fn)
+	require.NoError(t, err)
+	require.Equal(t, stampede.SourceStale, result.Source)
+	require.Equal(t, int64(1), result.Value)
+
+	time.Sleep(50 * time.Millisecond)
+	result, err = s1.DoResult(ctx, "t1", fn)
+	require.NoError(t, err)
+	require.Equal(t, stampede.SourceCache, result.Source)
+	require.Equal(t, int64(2), result.Value)
+	require.Equal(t, int64(2), numCalls.Load())
+}
+
+func TestCallOptions(t *testing.T) {
+	// the options of a call apply over the options of the instance
+	s := stampede.NewStampede[any](slog.Default(), newMockCacheBackend(),
+		stampede.WithTTL(5*time.Second),
+		stampede.WithStaleWhileRevalidate(5*time.Second),
+	)
+
+	var numCalls atomic.Int64
+	fn := func() (any, *time.Duration, error) {
+		return numCalls.Add(1), nil, nil
+	}
+
+	ctx := context.Background()
+	_, err := s.Do(ctx, "t1", fn, stampede.WithTTL(100*time.Millisecond))
+	require.NoError(t, err)
+
+	// the stale value is served while it's refreshed in the background
+	time.Sleep(150 * time.Millisecond)
+	v, err := s.Do(ctx, "t1", fn, stampede.WithTTL(100*time.Millisecond))
+	require.NoError(t, err)
+	require.Equal(t, int64(1), v)
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(t, int64(2), numCalls.Load())
+}
+
+func TestSetOptions(t *testing.T) {
+	s := stampede.NewStampede[any](slog.Default(), newMockCacheBackend(), stampede.WithTTL(5*time.Second))
+	ctx := context.Background()
+
+	// the options may be replaced while the instance is in use
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			v, err := s.Do(ctx, fmt.Sprintf("t%d", i), func() (any, *time.Duration, error) {
+				return "ok", nil, nil
+			})
+			assert.NoError(t, err)
+			assert.Equal(t, "ok", v)
+		}()
+		go func() {
+			defer wg.Done()
+			s.SetOptions(&stampede.Options{TTL: time.Duration(i+1) * time.Second, LocalCacheTTL: time.Second})
+		}()
+	}
+	wg.Wait()
+
+	// and apply to the calls made afterwards
+	s.SetOptions(&stampede.Options{TTL: 5 * time.Second, SkipCache: true})
+	var numCalls atomic.Int64
+	for i := 0; i < 2; i++ {
+		_, err := s.Do(ctx, "t1", func() (any, *time.Duration, error) {
+			return numCalls.Add(1), nil, nil
+		})
+		require.NoError(t, err)
+	}
+	require.Equal(t, int64(2), numCalls.Load())
+}
+
+func TestEarlyExpiration(t *testing.T) {
+	var numCalls atomic.Int64
+	s := stampede.NewStampede[any](slog.Default(), newMockCacheBackend(),
+		stampede.WithTTL(5*time.Second),
+		stampede.WithEarlyExpiration(100),
+	)
+
+	fn := func() (any, *time.Duration, error) {
+		n := numCalls.Add(1)
+		time.Sleep(50 * time.Millisecond)
+		return n, nil, nil
+	}
+
+	ctx := context.Background()
+
+	v, err := s.Do(ctx, "t1", fn)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), v)
+
+	// with a large beta, a hit is very likely to trigger an early refresh
+	// long before the entry expires, while still serving the cached value
+	for i := 0; i < 10 && numCalls.Load() == 1; i++ {
+		v, err := s.Do(ctx, "t1", fn)
+		require.NoError(t, err)
+		require.Equal(t, int64(1), v)
+		time.Sleep(100 * time.Millisecond)
+	}
+	require.Equal(t, int64(2), numCalls.Load())
+
+	v, err = s.Do(ctx, "t1", fn)
+	require.NoError(t, err)
+	require.Equal(t, int64(2), v)
+}
+
+func TestErrorTTL(t *testing.T) {
+	var numCalls atomic.Int64
+	errUpstream := errors.New("upstream failure")
+	errNotFound := errors.New("not found")
+
+	s := stampede.NewStampede[any](slog.Default(), newMockCacheBackend(),
+		stampede.WithTTL(5*time.Second),
+		stampede.WithErrorTTL(200*time.Millisecond),
+		stampede.WithErrorFilter(func(err error) bool {
+			return errors.Is(err, errUpstream)
+		}),
+	)
+
+	ctx := context.Background()
+
+	failing := func() (any, *time.Duration, error) {
+		numCalls.Add(1)
+		return nil, nil, fmt.Errorf("fetch: %w", errUpstream)
+	}
+
+	// the error is cached and replayed, without calling fn again
+	for i := 0; i < 5; i++ {
+		_, err := s.Do(ctx, "t1", failing)
+		require.ErrorIs(t, err, errUpstream)
+	}
+	require.Equal(t, int64(1), numCalls.Load())
+
+	// once the error ttl passes, fn is called again
+	time.Sleep(250 * time.Millisecond)
+	v, err := s.Do(ctx, "t1", func() (any, *time.Duration, error) {
+		numCalls.Add(1)
+		return "ok", nil, nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, "ok", v)
+	require.Equal(t, int64(2), numCalls.Load())
+
+	// errors rejected by the filter are not cached
+	for i := 0; i < 3; i++ {
+		_, err := s.Do(ctx, "t2", func() (any, *time.Duration, error) {
+			numCalls.Add(1)
+			return nil, nil, errNotFound
+		})
+		require.ErrorIs(t, err, errNotFound)
+	}
+	require.Equal(t, int64(5), numCalls.Load())
+}
+
+func TestErrorTTLCancelledFetch(t *testing.T) {
+	s := stampede.NewStampede[any](slog.Default(), newMockCacheBackend(),
+		stampede.WithTTL(5*time.Second),
+		stampede.WithErrorTTL(5*time.Second),
+	)
+
+	var numCalls atomic.Int64
+	fn := func(ctx context.Context) (any, *time.Duration, error) {
+		numCalls.Add(1)
+		select {
+		case <-time.After(200 * time.Millisecond):
+			return "ok", nil, nil
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
+	}
+
+	// the caller goes away, which cancels the fetch
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := s.DoCtx(ctx, "t1", fn)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	time.Sleep(50 * time.Millisecond)
+
+	// the error of the cancelled fetch is not cached
+	v, err := s.DoCtx(context.Background(), "t1", fn)
+	require.NoError(t, err)
+	require.Equal(t, "ok", v)
+	require.Equal(t, int64(2), numCalls.Load())
+}
+
+func TestStaleIfError(t *testing.T) {
+	errUpstream := errors.New("upstream failure")
+
+	s := stampede.NewStampede[any](slog.Default(), newMockCacheBackend(),
+		stampede.WithTTL(100*time.Millisecond),
+		stampede.WithStaleIfError(300*time.Millisecond),
+	)
+
+	ctx := context.Background()
+
+	v, err := s.Do(ctx, "t1", func() (any, *time.Duration, error) {
+		return "good", nil, nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, "good", v)
+
+	failing := func() (any, *time.Duration, error) {
+		return nil, nil, errUpstream
+	}
+
+	// refresh fails, the stale value is served along with a StaleError
+	time.Sleep(150 * time.Millisecond)
+	v, err = s.Do(ctx, "t1", failing)
+	require.Equal(t, "good", v)
+	var staleErr *stampede.StaleError
+	require.ErrorAs(t, err, &staleErr)
+	require.ErrorIs(t, err, errUpstream)
+	require.Greater(t, staleErr.StaleFor, time.Duration(0))
+
+	// once past the grace period, the error is returned
+	time.Sleep(300 * time.Millisecond)
+	v, err = s.Do(ctx, "t1", failing)
+	require.Nil(t, v)
+	require.ErrorIs(t, err, errUpstream)
+	require.False(t, errors.As(err, &staleErr))
+}
+
+func TestStaleIfErrorSharedBackend(t *testing.T) {
+	errUpstream := errors.New("upstream failure")
+
+	// a replica sharing the cache backend refreshes the value past its TTL,
+	// and falls back to it during the grace period
+	backend := newMockCacheBackend()
+	options := []stampede.Option{
+		stampede.WithTTL(100 * time.Millisecond),
+		stampede.WithStaleIfError(10 * time.Second),
+	}
+	s1 := stampede.NewStampede[any](slog.Default(), backend, options...)
+	s2 := stampede.NewStampede[any](slog.Default(), backend, options...)
+
+	ctx := context.Background()
+	_, err := s1.Do(ctx, "t1", func() (any, *time.Duration, error) {
+		return "v1", nil, nil
+	})
+	require.NoError(t, err)
+
+	time.Sleep(150 * time.Millisecond)
+	var numCalls atomic.Int64
+	result, err := s2.DoResult(ctx, "t1", func(ctx context.Context) (any, *time.Duration, error) {
+		numCalls.Add(1)
+		return nil, nil, errUpstream
+	})
+	require.Equal(t, int64(1), numCalls.Load())
+	require.Equal(t, "v1", result.Value)
+	require.Equal(t, stampede.SourceStale, result.Source)
+	require.Less(t, result.TTL, time.Duration(0))
+	var staleErr *stampede.StaleError
+	require.ErrorAs(t, err, &staleErr)
+
+	result, err = s2.DoResult(ctx, "t1", func(ctx context.Context) (any, *time.Duration, error) {
+		numCalls.Add(1)
+		return "v2", nil, nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, "v2", result.Value)
+	require.Equal(t, int64(2), numCalls.Load())
+}
+
+func TestDoCtx(t *testing.T) {
+	type ctxKey struct{}
+
+	s := stampede.NewStampede[any](slog.Default(), newMockCacheBackend(), stampede.WithTTL(5*time.Second))
+
+	fetchStarted := make(chan struct{})
+	fetchCancelled := make(chan struct{})
+	fn := func(ctx context.Context) (any, *time.Duration, error) {
+		// the fetch context carries the values of the leader's context
+		assert.Equal(t, "leader", ctx.Value(ctxKey{}))
+		close(fetchStarted)
+		select {
+		case <-ctx.Done():
+			close(fetchCancelled)
+			return nil, nil, ctx.Err()
+		case <-time.After(5 * time.Second):
+			return "result", nil, nil
+		}
+	}
+
+	ctx1, cancel1 := context.WithCancel(context.WithValue(context.Background(), ctxKey{}, "leader"))
+	ctx2, cancel2 := context.WithCancel(context.Background())
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		_, err := s.DoCtx(ctx1, "t1", fn)
+		assert.ErrorIs(t, err, context.Canceled)
+	}()
+	<-fetchStarted
+	go func() {
+		defer wg.Done()
+		_, err := s.DoCtx(ctx2, "t1", fn)
+		assert.ErrorIs(t, err, context.Canceled)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// the fetch keeps running while any caller is still waiting on it
+	cancel1()
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case <-fetchCancelled:
+		t.Fatal("fetch cancelled while a caller is still waiting")
+	default:
+	}
+
+	// and is cancelled once every caller has gone away
+	cancel2()
+	select {
+	case <-fetchCancelled:
+	case <-time.After(1 * time.Second):
+		t.Fatal("fetch not cancelled after every caller has gone away")
+	}
+	wg.Wait()
+}
+
+func TestDoCallerCancellation(t *testing.T) {
+	s := stampede.NewStampede[any](slog.Default(), newMockCacheBackend(), stampede.WithTTL(5*time.Second))
+
+	var numCalls atomic.Int64
+	fn := func() (any, *time.Duration, error) {
+		numCalls.Add(1)
+		time.Sleep(500 * time.Millisecond)
+		return "result", nil, nil
+	}
+
+	// the leader waits on the fetch
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		v, err := s.Do(context.Background(), "t1", fn)
+		assert.NoError(t, err)
+		assert.Equal(t, "result", v)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// a waiter returns as soon as its context is cancelled
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := s.Do(ctx, "t1", fn)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Less(t, time.Since(start), 300*time.Millisecond)
+
+	// while the leader carries on, and caches the result
+	wg.Wait()
+	v, err := s.Do(context.Background(), "t1", fn)
+	require.NoError(t, err)
+	require.Equal(t, "result", v)
+	require.Equal(t, int64(1), numCalls.Load())
+}
+
+func TestDoCtxFetchTimeout(t *testing.T) {
+	s := stampede.NewStampede[int](slog.Default(), nil)
+
+	_, err := s.DoCtx(context.Background(), "t1", func(ctx context.Context) (int, *time.Duration, error) {
+		<-ctx.Done()
+		return 0, nil, ctx.Err()
+	}, stampede.WithFetchTimeout(100*time.Millisecond))
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestDoHedgeDelay(t *testing.T) {
+	s := stampede.NewStampede[any](slog.Default(), newMockCacheBackend(), stampede.WithTTL(5*time.Second))
+
+	var numCalls atomic.Int64
+	fn := func(ctx context.Context) (any, *time.Duration, error) {
+		n := numCalls.Add(1)
+		if n == 1 {
+			// the first call is slow, until it's cancelled
+			select {
+			case <-time.After(5 * time.Second):
+			case <-ctx.Done():
+				return nil, nil, ctx.Err()
+			}
+		}
+		return n, nil, nil
+	}
+
+	start := time.Now()
+	v, err := s.DoCtx(context.Background(), "t1", fn, stampede.WithTTL(5*time.Second), stampede.WithHedgeDelay(100*time.Millisecond))
+	require.NoError(t, err)
+	require.Equal(t, int64(2), v)
+	require.Less(t, time.Since(start), time.Second)
+
+	// the hedged result was cached
+	v, err = s.DoCtx(context.Background(), "t1", fn)
+	require.NoError(t, err)
+	require.Equal(t, int64(2), v)
+	require.Equal(t, int64(2), numCalls.Load())
+}
+
+func TestDoRetries(t *testing.T) {
+	s := stampede.NewStampede[int](slog.Default(), nil)
+
+	var numCalls atomic.Int64
+	fn := func() (int, *time.Duration, error) {
+		if numCalls.Add(1) < 3 {
+			return 0, nil, errors.New("unavailable")
+		}
+		return 1, nil, nil
+	}
+
+	// concurrent callers share a single retry loop
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err := s.Do(context.Background(), "t1", fn, stampede.WithRetries(3), stampede.WithRetryBackoff(50*time.Millisecond))
+			assert.NoError(t, err)
+			assert.Equal(t, 1, v)
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, int64(3), numCalls.Load())
+
+	// the retries are bounded by the fetch timeout
+	start := time.Now()
+	_, err := s.Do(context.Background(), "t2", func() (int, *time.Duration, error) {
+		return 0, nil, errors.New("unavailable")
+	}, stampede.WithRetries(100), stampede.WithRetryBackoff(50*time.Millisecond), stampede.WithFetchTimeout(200*time.Millisecond))
+	require.EqualError(t, err, "unavailable")
+	require.Less(t, time.Since(start), time.Second)
+
+	// and only selected errors are retried
+	numCalls.Store(0)
+	_, err = s.Do(context.Background(), "t3", func() (int, *time.Duration, error) {
+		numCalls.Add(1)
+		return 0, nil, errors.New("not found")
+	}, stampede.WithRetries(3), stampede.WithRetryFilter(func(err error) bool {
+		return err.Error() == "unavailable"
+	}))
+	require.Error(t, err)
+	require.Equal(t, int64(1), numCalls.Load())
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	s := stampede.NewStampede[string](slog.Default(), nil,
+		stampede.WithCircuitBreaker(2),
+		stampede.WithCircuitBreakerCooldown(200*time.Millisecond),
+		stampede.WithCircuitBreakerGroup(func(key string) string {
+			return strings.Split(key, ":")[1]
+		}),
+	)
+
+	var numCalls atomic.Int64
+	failing := func() (string, *time.Duration, error) {
+		numCalls.Add(1)
+		return "", nil, errors.New("unavailable")
+	}
+	ctx := context.Background()
+
+	// the breaker opens after consecutive failures
+	for i := 0; i < 2; i++ {
+		_, err := s.Do(ctx, "a:1", failing)
+		require.EqualError(t, err, "unavailable")
+	}
+	_, err := s.Do(ctx, "a:2", failing)
+	require.ErrorIs(t, err, stampede.ErrCircuitOpen)
+	require.Equal(t, int64(2), numCalls.Load())
+
+	// while the other groups are unaffected
+	v, err := s.Do(ctx, "b:1", func() (string, *time.Duration, error) {
+		return "b", nil, nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, "b", v)
+
+	// once half-open, a failed probe opens it again
+	time.Sleep(250 * time.Millisecond)
+	_, err = s.Do(ctx, "a:1", failing)
+	require.EqualError(t, err, "unavailable")
+	_, err = s.Do(ctx, "a:1", failing)
+	require.ErrorIs(t, err, stampede.ErrCircuitOpen)
+	require.Equal(t, int64(3), numCalls.Load())
+
+	// and a successful probe closes it
+	time.Sleep(250 * time.Millisecond)
+	for i := 0; i < 2; i++ {
+		v, err = s.Do(ctx, "a:1", func() (string, *time.Duration, error) {
+			return "a", nil, nil
+		})
+		require.NoError(t, err)
+		require.Equal(t, "a", v)
+	}
+}
+
+func TestTTLJitter(t *testing.T) {
+	s := stampede.NewStampede[any](slog.Default(), newMockCacheBackend())
+
+	fn := func(ctx context.Context) (any, *time.Duration, error) {
+		return "result", nil, nil
+	}
+	ttlFn := func(ctx context.Context) (any, *time.Duration, error) {
+		ttl := 10 * time.Second
+		return "result", &ttl, nil
+	}
+
+	ttls := map[time.Duration]bool{}
+	for i := 0; i < 20; i++ {
+		result, err := s.DoResult(context.Background(), fmt.Sprintf("t%d", i), fn, stampede.WithTTL(time.Minute), stampede.WithTTLJitter(0.2))
+		require.NoError(t, err)
+		require.LessOrEqual(t, result.TTL, time.Minute)
+		require.Greater(t, result.TTL, 47*time.Second)
+		ttls[result.TTL.Round(time.Millisecond)] = true
+
+		// TTLs returned by the fetch function are jittered as well
+		result, err = s.DoResult(context.Background(), fmt.Sprintf("r%d", i), ttlFn, stampede.WithTTLJitterRange(2*time.Second))
+		require.NoError(t, err)
+		require.LessOrEqual(t, result.TTL, 10*time.Second)
+		require.Greater(t, result.TTL, 7*time.Second)
+	}
+	require.Greater(t, len(ttls), 1)
+}
+
+func TestRegisterRefresh(t *testing.T) {
+	s := stampede.NewStampede[any](slog.Default(), newMockCacheBackend(), stampede.WithTTL(time.Second))
+
+	var numCalls atomic.Int64
+	err := s.RegisterRefresh("t1", 200*time.Millisecond, func(ctx context.Context) (any, *time.Duration, error) {
+		n := numCalls.Add(1)
+		time.Sleep(100 * time.Millisecond)
+		return n, nil, nil
+	})
+	require.NoError(t, err)
+
+	// a call during a refresh shares its flight
+	time.Sleep(50 * time.Millisecond)
+	v, err := s.Do(context.Background(), "t1", func() (any, *time.Duration, error) {
+		t.Error("unexpected fetch")
+		return nil, nil, nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, int64(1), v)
+
+	// the key is refreshed on schedule, every interval after the previous
+	// refresh completed
+	time.Sleep(700 * time.Millisecond)
+	require.GreaterOrEqual(t, numCalls.Load(), int64(3))
+	v, err = s.Do(context.Background(), "t1", func() (any, *time.Duration, error) {
+		t.Error("unexpected fetch")
+		return nil, nil, nil
+	})
+	require.NoError(t, err)
+	require.Greater(t, v, int64(1))
+
+	// and refreshes stop once closed
+	require.NoError(t, s.Close(context.Background()))
+	n := numCalls.Load()
+	time.Sleep(300 * time.Millisecond)
+	require.Equal(t, n, numCalls.Load())
+
+	err = s.RegisterRefresh("t2", time.Second, func(ctx context.Context) (any, *time.Duration, error) {
+		return nil, nil, nil
+	})
+	require.ErrorIs(t, err, stampede.ErrClosed)
+}
+
+func TestClose(t *testing.T) {
+	s := stampede.NewStampede[any](slog.Default(), newMockCacheBackend(), stampede.WithTTL(time.Minute))
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		// the caller goes away, while the fetch carries on
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		_, err := s.Do(ctx, "t1", func() (any, *time.Duration, error) {
+			time.Sleep(300 * time.Millisecond)
+			return "result", nil, nil
+		})
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// close waits for the fetch in progress
+	start := time.Now()
+	require.NoError(t, s.Close(context.Background()))
+	require.Greater(t, time.Since(start), 100*time.Millisecond)
+	wg.Wait()
+
+	// and rejects new calls
+	_, err := s.Do(context.Background(), "t2", func() (any, *time.Duration, error) {
+		t.Error("unexpected fetch")
+		return nil, nil, nil
+	})
+	require.ErrorIs(t, err, stampede.ErrClosed)
+
+	// closing is bounded by ctx
+	s = stampede.NewStampede[any](slog.Default(), newMockCacheBackend())
+	go s.Do(context.Background(), "t1", func() (any, *time.Duration, error) {
+		time.Sleep(time.Second)
+		return "result", nil, nil
+	})
+	time.Sleep(50 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, s.Close(ctx), context.DeadlineExceeded)
+}
+
+func TestWriteBehind(t *testing.T) {
+	backend := &slowWriteBackend{Backend: newMockCacheBackend(), delay: 200 * time.Millisecond}
+	s := stampede.NewStampede[any](slog.Default(), backend, stampede.WithTTL(time.Minute), stampede.WithWriteBehind(1))
+
+	fn := func() (any, *time.Duration, error) {
+		return "result", nil, nil
+	}
+
+	// values are returned without waiting on the writes, and the writes
+	// which don't fit in the queue are dropped
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		v, err := s.Do(context.Background(), fmt.Sprintf("t%d", i), fn)
+		require.NoError(t, err)
+		require.Equal(t, "result", v)
+	}
+	require.Less(t, time.Since(start), 100*time.Millisecond)
+	dropped := s.Stats().DroppedWrites
+	require.Greater(t, dropped, uint64(0))
+
+	// close flushes the queued writes
+	require.NoError(t, s.Close(context.Background()))
+	var cached uint64
+	for i := 0; i < 10; i++ {
+		_, ok, err := backend.Get(context.Background(), fmt.Sprintf("stampede.v2:t%d", i))
+		require.NoError(t, err)
+		if ok {
+			cached++
+		}
+	}
+	require.Equal(t, uint64(10), cached+dropped)
+}
+
+func TestWriteBehindPending(t *testing.T) {
+	backend := &slowWriteBackend{Backend: newMockCacheBackend(), delay: 200 * time.Millisecond}
+	s := stampede.NewStampede[any](slog.Default(), backend, stampede.WithTTL(time.Minute), stampede.WithWriteBehind(16))
+
+	var numCalls atomic.Int64
+	fn := func() (any, *time.Duration, error) {
+		return numCalls.Add(1), nil, nil
+	}
+
+	// the value is served while its write is pending, without fetching it
+	// again
+	ctx := context.Background()
+	for i := 0; i < 5; i++ {
+		v, err := s.Do(ctx, "t1", fn)
+		require.NoError(t, err)
+		require.Equal(t, int64(1), v)
+	}
+	values, err := s.DoMulti(ctx, []string{"t1"}, func(missing []string) (map[string]any, error) {
+		t.Fatal("unexpected fetch")
+		return nil, nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, map[string]any{"t1": int64(1)}, values)
+
+	// unless it's invalidated
+	require.NoError(t, s.Invalidate(ctx, "t1"))
+	v, err := s.Do(ctx, "t1", fn)
+	require.NoError(t, err)
+	require.Equal(t, int64(2), v)
+
+	require.NoError(t, s.Close(ctx))
+	require.Equal(t, int64(2), numCalls.Load())
+}
+
+func TestLocalCache(t *testing.T) {
+	backend := newMockCacheBackend()
+	s := stampede.NewStampede[any](slog.Default(), backend, stampede.WithTTL(time.Minute), stampede.WithLocalCache(200*time.Millisecond))
+	ctx := context.Background()
+
+	var numCalls atomic.Int64
+	fn := func() (any, *time.Duration, error) {
+		return numCalls.Add(1), nil, nil
+	}
+
+	v, err := s.Do(ctx, "t1", fn)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), v)
+	_, ok, _ := backend.Get(ctx, "stampede.v2:t1")
+	require.True(t, ok)
+
+	// the value is served from the local cache, while it's still cached
+	// locally
+	require.NoError(t, backend.ClearAll(ctx))
+	v, err = s.Do(ctx, "t1", fn)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), v)
+
+	// and fetched again once expired locally, as the cache store was cleared
+	time.Sleep(250 * time.Millisecond)
+	v, err = s.Do(ctx, "t1", fn)
+	require.NoError(t, err)
+	require.Equal(t, int64(2), v)
+
+	// invalidation removes the value from both caches
+	require.NoError(t, s.Invalidate(ctx, "t1"))
+	_, ok, _ = backend.Get(ctx, "stampede.v2:t1")
+	require.False(t, ok)
+	v, err = s.Do(ctx, "t1", fn)
+	require.NoError(t, err)
+	require.Equal(t, int64(3), v)
+}
+
+func TestLocker(t *testing.T) {
+	// two replicas sharing a cache backend and a locker
+	backend := newMockCacheBackend()
+	locker := stampede.NewMemLocker()
+	replicas := []*stampede.Stampede[any]{
+		stampede.NewStampede[any](slog.Default(), backend, stampede.WithTTL(time.Minute), stampede.WithLocker(locker)),
+		stampede.NewStampede[any](slog.Default(), backend, stampede.WithTTL(time.Minute), stampede.WithLocker(locker)),
+	}
+
+	var numCalls atomic.Int64
+	fn := func() (any, *time.Duration, error) {
+		numCalls.Add(1)
+		time.Sleep(200 * time.Millisecond)
+		return "result", nil, nil
+	}
+
+	// a single replica fetches the key
+	var wg sync.WaitGroup
+	for _, s := range replicas {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err := s.Do(context.Background(), "t1", fn)
+			assert.NoError(t, err)
+			assert.Equal(t, "result", v)
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, int64(1), numCalls.Load())
+
+	// the lease of a replica which died while fetching expires, and is
+	// taken over
+	ok, err := locker.Lock(context.Background(), "stampede.v2:t2:lease", "dead", 200*time.Millisecond)
+	require.NoError(t, err)
+	require.True(t, ok)
+	start := time.Now()
+	v, err := replicas[0].Do(context.Background(), "t2", fn)
+	require.NoError(t, err)
+	require.Equal(t, "result", v)
+	require.GreaterOrEqual(t, time.Since(start), 200*time.Millisecond)
+	require.Equal(t, int64(2), numCalls.Load())
+}
+
+func TestStoreLocker(t *testing.T) {
+	// two replicas sharing a cache backend, which holds the leases
+	backend, err := memcache.NewBackend(1000)
+	require.NoError(t, err)
+	locker := stampede.NewStoreLocker(backend)
+	replicas := []*stampede.Stampede[string]{
+		stampede.NewStampede[string](slog.Default(), backend, stampede.WithTTL(time.Minute), stampede.WithLocker(locker)),
+		stampede.NewStampede[string](slog.Default(), backend, stampede.WithTTL(time.Minute), stampede.WithLocker(locker)),
+	}
+
+	var numCalls atomic.Int64
+	fn := func() (string, *time.Duration, error) {
+		numCalls.Add(1)
+		time.Sleep(200 * time.Millisecond)
+		return "result", nil, nil
+	}
+
+	// a single replica fetches the key
+	var wg sync.WaitGroup
+	for _, s := range replicas {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err := s.Do(context.Background(), "t1", fn)
+			assert.NoError(t, err)
+			assert.Equal(t, "result", v)
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, int64(1), numCalls.Load())
+
+	// the lease is released once the value is cached
+	ok, err := backend.Exists(context.Background(), "stampede.v2:t1:lease")
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	// a lease is exclusive until released by its owner, or expired
+	ctx := context.Background()
+	ok, err = locker.Lock(ctx, "t2:lease", "a", 200*time.Millisecond)
+	require.NoError(t, err)
+	require.True(t, ok)
+	ok, err = locker.Lock(ctx, "t2:lease", "b", 200*time.Millisecond)
+	require.NoError(t, err)
+	require.False(t, ok)
+	require.NoError(t, locker.Unlock(ctx, "t2:lease", "b"))
+	ok, err = locker.Lock(ctx, "t2:lease", "b", 200*time.Millisecond)
+	require.NoError(t, err)
+	require.False(t, ok)
+	time.Sleep(250 * time.Millisecond)
+	ok, err = locker.Lock(ctx, "t2:lease", "b", 200*time.Millisecond)
+	require.NoError(t, err)
+	require.True(t, ok)
+}
+
+func TestLockerRefresh(t *testing.T) {
+	var numCalls atomic.Int64
+	fn := func(ctx context.Context) (any, *time.Duration, error) {
+		return numCalls.Add(1), nil, nil
+	}
+	ctx := context.Background()
+
+	// stale values are refreshed, rather than taken for the value fetched
+	// by another replica
+	s := stampede.NewStampede[any](slog.Default(), newMockCacheBackend(),
+		stampede.WithTTL(100*time.Millisecond),
+		stampede.WithStaleWhileRevalidate(5*time.Second),
+		stampede.WithLocker(stampede.NewMemLocker()),
+	)
+	_, err := s.DoCtx(ctx, "t1", fn)
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		time.Sleep(150 * time.Millisecond)
+		_, err := s.DoCtx(ctx, "t1", fn)
+		require.NoError(t, err)
+	}
+	require.GreaterOrEqual(t, numCalls.Load(), int64(4))
+	v, err := s.DoCtx(ctx, "t1", fn)
+	require.NoError(t, err)
+	require.Greater(t, v, int64(1))
+
+	// and so are the keys refreshed ahead of their expiry
+	numCalls.Store(0)
+	s = stampede.NewStampede[any](slog.Default(), newMockCacheBackend(),
+		stampede.WithTTL(time.Minute),
+		stampede.WithLocker(stampede.NewMemLocker()),
+	)
+	require.NoError(t, s.RegisterRefresh("t1", 50*time.Millisecond, fn))
+	time.Sleep(400 * time.Millisecond)
+	require.NoError(t, s.Close(ctx))
+	require.Greater(t, numCalls.Load(), int64(3))
+}
+
+func TestLockerWriteBehind(t *testing.T) {
+	// the lease is held until the value is written, so the other replica
+	// waits on it rather than fetching the key again
+	backend := &slowWriteBackend{Backend: newMockCacheBackend(), delay: 200 * time.Millisecond}
+	locker := stampede.NewMemLocker()
+	options := []stampede.Option{
+		stampede.WithTTL(time.Minute),
+		stampede.WithWriteBehind(16),
+		stampede.WithLocker(locker),
+	}
+	s1 := stampede.NewStampede[any](slog.Default(), backend, options...)
+	s2 := stampede.NewStampede[any](slog.Default(), backend, options...)
+
+	var numCalls atomic.Int64
+	fn := func() (any, *time.Duration, error) {
+		return numCalls.Add(1), nil, nil
+	}
+
+	ctx := context.Background()
+	v, err := s1.Do(ctx, "t1", fn)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), v)
+	v, err = s2.Do(ctx, "t1", fn)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), v)
+	require.Equal(t, int64(1), numCalls.Load())
+
+	require.NoError(t, s1.Close(ctx))
+	require.NoError(t, s2.Close(ctx))
+}
+
+func TestDoPanic(t *testing.T) {
+	s := stampede.NewStampede[any](slog.Default(), newMockCacheBackend(), stampede.WithTTL(5*time.Second))
+
+	fn := func() (any, *time.Duration, error) {
+		time.Sleep(200 * time.Millisecond)
+		panic("boom")
+	}
+
+	// the panic is delivered to every caller as a *PanicError
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := s.Do(context.Background(), "t1", fn)
+			var perr *stampede.PanicError
+			if assert.ErrorAs(t, err, &perr) {
+				assert.Equal(t, "boom", perr.Value)
+				assert.NotEmpty(t, perr.Stack)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// and nothing was cached
+	v, err := s.Do(context.Background(), "t1", func() (any, *time.Duration, error) {
+		return "result", nil, nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, "result", v)
+}
+
+func TestDoRepanic(t *testing.T) {
+	s := stampede.NewStampede[int](slog.Default(), nil, stampede.WithRepanic(true))
+
+	// the leader re-panics
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer func() {
+			perr, ok := recover().(*stampede.PanicError)
+			if assert.True(t, ok) {
+				assert.EqualError(t, perr.Unwrap(), "boom")
+			}
+		}()
+		s.Do(context.Background(), "t1", func() (int, *time.Duration, error) {
+			time.Sleep(200 * time.Millisecond)
+			panic(errors.New("boom"))
+		})
+		t.Error("expected a panic")
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// while the waiters receive the error
+	_, err := s.Do(context.Background(), "t1", func() (int, *time.Duration, error) {
+		return 1, nil, nil
+	}, stampede.WithRepanic(true))
+	var perr *stampede.PanicError
+	require.ErrorAs(t, err, &perr)
+	require.EqualError(t, errors.Unwrap(err), "boom")
+	wg.Wait()
+}
+
+func TestStats(t *testing.T) {
+	var s stampede.Doer[any] = stampede.NewStampede[any](slog.Default(), newMockCacheBackend(), stampede.WithTTL(5*time.Second))
+
+	ctx := context.Background()
+	fn := func() (any, *time.Duration, error) {
+		return "result", nil, nil
+	}
+
+	for i := 0; i < 3; i++ {
+		_, err := s.Do(ctx, "t1", fn)
+		require.NoError(t, err)
+	}
+	_, err := s.Do(ctx, "t2", func() (any, *time.Duration, error) {
+		return nil, nil, errors.New("failed")
+	})
+	require.Error(t, err)
+
+	require.Equal(t, stampede.Stats{
+		Hits:        2,
+		Misses:      2,
+		Fetches:     2,
+		FetchErrors: 1,
+	}, s.Stats())
+}
+
+func TestInvalidate(t *testing.T) {
+	s := stampede.NewStampede[any](slog.Default(), newMockCacheBackend(), stampede.WithTTL(5*time.Second))
+
+	ctx := context.Background()
+	var numCalls atomic.Int64
+	fn := func() (any, *time.Duration, error) {
+		return numCalls.Add(1), nil, nil
+	}
+
+	for _, key := range []string{"t1", "t2", "user:1", "user:2"} {
+		_, err := s.Do(ctx, key, fn)
+		require.NoError(t, err)
+	}
+	require.Equal(t, int64(4), numCalls.Load())
+
+	require.NoError(t, s.Invalidate(ctx, "t1"))
+	v, err := s.Do(ctx, "t1", fn)
+	require.NoError(t, err)
+	require.Equal(t, int64(5), v)
+
+	require.NoError(t, s.InvalidatePrefix(ctx, "user:"))
+	for _, key := range []string{"t2", "user:1", "user:2"} {
+		_, err := s.Do(ctx, key, fn)
+		require.NoError(t, err)
+	}
+	require.Equal(t, int64(7), numCalls.Load())
+}
+
+type taggedValue struct {
+	Value string
+	Tags  []string
+}
+
+func (v taggedValue) CacheTags() []string {
+	return v.Tags
+}
+
+func TestInvalidateTag(t *testing.T) {
+	s := stampede.NewStampede[any](slog.Default(), newMockCacheBackend(), stampede.WithTTL(5*time.Second))
+
+	ctx := context.Background()
+	var numCalls atomic.Int64
+	fn := func(tags ...string) func() (any, *time.Duration, error) {
+		return func() (any, *time.Duration, error) {
+			numCalls.Add(1)
+			return taggedValue{Value: "ok", Tags: tags}, nil, nil
+		}
+	}
+
+	// tagged by option, by value, or both
+	_, err := s.Do(ctx, "t1", fn(), stampede.WithTags("account:42"))
+	require.NoError(t, err)
+	_, err = s.Do(ctx, "t2", fn("account:42"))
+	require.NoError(t, err)
+	_, err = s.Do(ctx, "t3", fn("account:7"), stampede.WithTags("accounts"))
+	require.NoError(t, err)
+	require.Equal(t, int64(3), numCalls.Load())
+
+	require.NoError(t, s.InvalidateTag(ctx, "account:42"))
+	for _, key := range []string{"t1", "t2", "t3"} {
+		_, err := s.Do(ctx, key, fn())
+		require.NoError(t, err)
+	}
+	require.Equal(t, int64(5), numCalls.Load())
+
+	require.NoError(t, s.InvalidateTag(ctx, "accounts"))
+	_, err = s.Do(ctx, "t3", fn())
+	require.NoError(t, err)
+	require.Equal(t, int64(6), numCalls.Load())
+
+	// the pending write-behind of a tagged value is dropped as well
+	backend := &slowWriteBackend{Backend: newMockCacheBackend(), delay: 200 * time.Millisecond}
+	s = stampede.NewStampede[any](slog.Default(), backend, stampede.WithTTL(5*time.Second), stampede.WithWriteBehind(16))
+	_, err = s.Do(ctx, "t1", fn(), stampede.WithTags("account:42"))
+	require.NoError(t, err)
+	_, err = s.Do(ctx, "t2", fn())
+	require.NoError(t, err)
+	require.NoError(t, s.InvalidateTag(ctx, "account:42"))
+	require.NoError(t, s.Close(ctx))
+	ok, err := backend.Exists(ctx, "stampede.v2:t1")
+	require.NoError(t, err)
+	require.False(t, ok)
+	ok, err = backend.Exists(ctx, "stampede.v2:t2")
+	require.NoError(t, err)
+	require.True(t, ok)
+}
+
+func TestInvalidateTagSharedBackend(t *testing.T) {
+	tests := []struct {
+		name    string
+		options []stampede.Option
+	}{
+		{"locker", []stampede.Option{stampede.WithLocker(stampede.NewMemLocker())}},
+		// the index is updated under a lease taken in the cache backend
+		{"backend", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// two replicas sharing a slow cache backend, so their updates
+			// of the index overlap
+			backend := &slowWriteBackend{Backend: newMockCacheBackend(), delay: 5 * time.Millisecond}
+			options := append([]stampede.Option{stampede.WithTTL(5 * time.Second), stampede.WithLockPollInterval(time.Millisecond)}, tt.options...)
+			s1 := stampede.NewStampede[any](slog.Default(), backend, options...)
+			s2 := stampede.NewStampede[any](slog.Default(), backend, options...)
+
+			ctx := context.Background()
+			fn := func() (any, *time.Duration, error) {
+				return "ok", nil, nil
+			}
+
+			// the tagged keys cached concurrently by both replicas are all
+			// indexed
+			var wg sync.WaitGroup
+			for i := range 20 {
+				s := s1
+				if i%2 == 1 {
+					s = s2
+				}
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					_, err := s.Do(ctx, fmt.Sprintf("t%d", i), fn, stampede.WithTags("account:42"))
+					require.NoError(t, err)
+				}()
+			}
+			wg.Wait()
+			_, err := s1.Do(ctx, "other", fn, stampede.WithTags("account:7"))
+			require.NoError(t, err)
+
+			require.NoError(t, s2.InvalidateTag(ctx, "account:42"))
+			for i := range 20 {
+				ok, err := backend.Exists(ctx, fmt.Sprintf("stampede.v2:t%d", i))
+				require.NoError(t, err)
+				require.False(t, ok)
+			}
+			ok, err := backend.Exists(ctx, "stampede.v2:other")
+			require.NoError(t, err)
+			require.True(t, ok)
+		})
+	}
+}
+
+func TestCacheValueFormat(t *testing.T) {
+	backend := newByteCacheBackend()
+	s := stampede.NewStampede[string](slog.Default(), backend, stampede.WithTTL(5*time.Second))
+
+	ctx := context.Background()
+	var numCalls atomic.Int64
+	fn := func() (string, *time.Duration, error) {
+		numCalls.Add(1)
+		return "ok", nil, nil
+	}
+
+	// values which aren't envelopes, ie. cached by an older version, are
+	// fetched again instead of failing to decode
+	require.NoError(t, backend.bytes.Set(ctx, "stampede.v2:t1", []byte("raw")))
+	require.NoError(t, backend.bytes.Set(ctx, "stampede.v2:t2", []byte(`{"headers":{},"status":200}`)))
+	for _, key := range []string{"t1", "t2"} {
+		v, err := s.Do(ctx, key, fn)
+		require.NoError(t, err)
+		require.Equal(t, "ok", v)
+	}
+	require.Equal(t, int64(2), numCalls.Load())
+
+	// likewise for DoMulti, where the batch is read in one go
+	require.NoError(t, backend.bytes.Set(ctx, "stampede.v2:t3", []byte("raw")))
+	values, err := s.DoMulti(ctx, []string{"t1", "t3"}, func(missing []string) (map[string]string, error) {
+		require.Equal(t, []string{"t3"}, missing)
+		return map[string]string{"t3": "ok"}, nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"t1": "ok", "t3": "ok"}, values)
+
+	// values cached by an older version under the former default namespace
+	// are left alone
+	require.NoError(t, backend.bytes.Set(ctx, "stampede:t4", []byte("old")))
+	v, err := s.Do(ctx, "t4", fn)
+	require.NoError(t, err)
+	require.Equal(t, "ok", v)
+	old, _, err := backend.bytes.Get(ctx, "stampede:t4")
+	require.NoError(t, err)
+	require.Equal(t, "old", string(old))
+}
+
+func TestForgetInFlight(t *testing.T) {
+	s := stampede.NewStampede[any](slog.Default(), newMockCacheBackend(), stampede.WithTTL(5*time.Second))
+
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		v, err := s.Do(ctx, "t1", func() (any, *time.Duration, error) {
+			time.Sleep(200 * time.Millisecond)
+			return "old", nil, nil
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, "old", v)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// the next call starts a new fetch, instead of waiting on the forgotten one
+	s.Forget("t1")
+	v, err := s.Do(ctx, "t1", func() (any, *time.Duration, error) {
+		return "new", nil, nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, "new", v)
+
+	// the forgotten fetch completes, but does not overwrite the cached value
+	wg.Wait()
+	v, err = s.Do(ctx, "t1", func() (any, *time.Duration, error) {
+		return "unexpected", nil, nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, "new", v)
+}
+
+func TestNamespace(t *testing.T) {
+	ctx := context.Background()
+	cache := newMockCacheBackend()
+
+	s1 := stampede.NewStampede[any](slog.Default(), cache, stampede.WithTTL(5*time.Second), stampede.WithNamespace("svc1"))
+	s2 := stampede.NewStampede[any](slog.Default(), cache, stampede.WithTTL(5*time.Second), stampede.WithNamespace("svc2"))
+	s3 := stampede.NewStampede[any](slog.Default(), cache, stampede.WithTTL(5*time.Second),
+		stampede.WithKeyFunc(func(namespace, key string) string {
+			return "app/" + key
+		}),
+	)
+
+	for i, s := range []*stampede.Stampede[any]{s1, s2, s3} {
+		v, err := s.Do(ctx, "t1", func() (any, *time.Duration, error) {
+			return i, nil, nil
+		})
+		require.NoError(t, err)
+		require.Equal(t, i, v)
+	}
+
+	for _, key := range []string{"svc1:t1", "svc2:t1", "app/t1"} {
+		ok, err := cache.Exists(ctx, key)
+		require.NoError(t, err)
+		require.True(t, ok, key)
+	}
+
+	// invalidation is scoped to the namespace
+	require.NoError(t, s1.InvalidatePrefix(ctx, ""))
+	ok, err := cache.Exists(ctx, "svc1:t1")
+	require.NoError(t, err)
+	require.False(t, ok)
+	ok, err = cache.Exists(ctx, "svc2:t1")
+	require.NoError(t, err)
+	require.True(t, ok)
+}
+
+func TestDoMulti(t *testing.T) {
+	s := stampede.NewStampede[any](slog.Default(), newMockCacheBackend(), stampede.WithTTL(5*time.Second))
+	ctx := context.Background()
+
+	for _, key := range []string{"a", "b"} {
+		_, err := s.Do(ctx, key, func() (any, *time.Duration, error) {
+			return "cached " + key, nil, nil
+		})
+		require.NoError(t, err)
+	}
+
+	// "x" is being fetched by another caller, and is shared with DoMulti
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, err := s.Do(ctx, "x", func() (any, *time.Duration, error) {
+			time.Sleep(200 * time.Millisecond)
+			return "shared x", nil, nil
+		})
+		assert.NoError(t, err)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	var numCalls atomic.Int64
+	values, err := s.DoMulti(ctx, []string{"a", "b", "c", "d", "x", "c"}, func(missing []string) (map[string]any, error) {
+		numCalls.Add(1)
+		assert.Equal(t, []string{"c", "d"}, missing)
+		// "d" doesn't exist
+		return map[string]any{"c": "fetched c"}, nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, int64(1), numCalls.Load())
+	require.Equal(t, map[string]any{
+		"a": "cached a",
+		"b": "cached b",
+		"c": "fetched c",
+		"x": "shared x",
+	}, values)
+	wg.Wait()
+
+	// fetched values are cached
+	values, err = s.DoMulti(ctx, []string{"c", "x"}, func(missing []string) (map[string]any, error) {
+		t.Fatal("unexpected fetch")
+		return nil, nil
+	})
+	require.NoError(t, err)
+	require.Len(t, values, 2)
+}
+
+func TestDoMultiErrorTTL(t *testing.T) {
+	s := stampede.NewStampede[any](slog.Default(), newMockCacheBackend(),
+		stampede.WithTTL(5*time.Second),
+		stampede.WithErrorTTL(5*time.Second),
+	)
+	ctx := context.Background()
+
+	// the missing key is not fetched again
+	var numCalls atomic.Int64
+	for i := 0; i < 3; i++ {
+		values, err := s.DoMulti(ctx, []string{"a", "missing"}, func(missing []string) (map[string]any, error) {
+			numCalls.Add(1)
+			return map[string]any{"a": "fetched a"}, nil
+		})
+		require.NoError(t, err)
+		require.Equal(t, map[string]any{"a": "fetched a"}, values)
+	}
+	require.Equal(t, int64(1), numCalls.Load())
+
+	// while Do still fetches it
+	v, err := s.Do(ctx, "missing", func() (any, *time.Duration, error) {
+		return "found", nil, nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, "found", v)
+
+	// failed fetches are replayed as well
+	errUpstream := errors.New("upstream failure")
+	for i := 0; i < 3; i++ {
+		_, err := s.DoMulti(ctx, []string{"b"}, func(missing []string) (map[string]any, error) {
+			numCalls.Add(1)
+			return nil, errUpstream
+		})
+		require.ErrorIs(t, err, errUpstream)
+	}
+	require.Equal(t, int64(2), numCalls.Load())
+}
+
+func TestDoMultiRetries(t *testing.T) {
+	s := stampede.NewStampede[any](slog.Default(), newMockCacheBackend(), stampede.WithTTL(5*time.Second))
+	ctx := context.Background()
+
+	// the batch is fetched again on failure, with a single retry loop for
+	// all of its keys
+	var numCalls atomic.Int64
+	values, err := s.DoMulti(ctx, []string{"a", "b", "c"}, func(missing []string) (map[string]any, error) {
+		if numCalls.Add(1) < 3 {
+			return nil, errors.New("unavailable")
+		}
+		values := make(map[string]any, len(missing))
+		for _, key := range missing {
+			values[key] = "fetched " + key
+		}
+		return values, nil
+	}, stampede.WithRetries(3), stampede.WithRetryBackoff(20*time.Millisecond))
+	require.NoError(t, err)
+	require.Equal(t, map[string]any{"a": "fetched a", "b": "fetched b", "c": "fetched c"}, values)
+	require.Equal(t, int64(3), numCalls.Load())
+
+	// and gives up once the retries are exhausted
+	numCalls.Store(0)
+	_, err = s.DoMulti(ctx, []string{"d", "e"}, func(missing []string) (map[string]any, error) {
+		numCalls.Add(1)
+		return nil, errors.New("unavailable")
+	}, stampede.WithRetries(2), stampede.WithRetryBackoff(20*time.Millisecond))
+	require.EqualError(t, err, "unavailable")
+	require.Equal(t, int64(3), numCalls.Load())
+}
+
+func TestDoMultiCircuitBreaker(t *testing.T) {
+	s := stampede.NewStampede[any](slog.Default(), newMockCacheBackend(), stampede.WithTTL(5*time.Second), stampede.WithCircuitBreaker(3))
+	ctx := context.Background()
+
+	var numCalls atomic.Int64
+	failing := func(missing []string) (map[string]any, error) {
+		numCalls.Add(1)
+		return nil, errors.New("unavailable")
+	}
+	fn := func() (any, *time.Duration, error) {
+		return "ok", nil, nil
+	}
+
+	// a failed batch counts as a single failure, however many keys it has
+	_, err := s.DoMulti(ctx, []string{"a", "b", "c", "d", "e"}, failing)
+	require.EqualError(t, err, "unavailable")
+	v, err := s.Do(ctx, "other", fn)
+	require.NoError(t, err)
+	require.Equal(t, "ok", v)
+
+	// and the breaker opens after consecutive failed batches
+	for i := 0; i < 3; i++ {
+		_, err := s.DoMulti(ctx, []string{"a", "b", "c", "d", "e"}, failing)
+		require.EqualError(t, err, "unavailable")
+	}
+	require.Equal(t, int64(4), numCalls.Load())
+	_, err = s.DoMulti(ctx, []string{"a", "b"}, failing)
+	require.ErrorIs(t, err, stampede.ErrCircuitOpen)
+	require.Equal(t, int64(4), numCalls.Load())
+	_, err = s.Do(ctx, "other2", fn)
+	require.ErrorIs(t, err, stampede.ErrCircuitOpen)
+}
+
+func TestDoResult(t *testing.T) {
+	s := stampede.NewStampede[any](slog.Default(), newMockCacheBackend(), stampede.WithTTL(5*time.Second))
+	ctx := context.Background()
+
+	fetchStarted := make(chan struct{})
+	fn := func(ctx context.Context) (any, *time.Duration, error) {
+		close(fetchStarted)
+		time.Sleep(100 * time.Millisecond)
+		return "result", nil, nil
+	}
+
+	var wg sync.WaitGroup
+	var leader, waiter stampede.Result[any]
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		var err error
+		leader, err = s.DoResult(ctx, "t1", fn)
+		assert.NoError(t, err)
+	}()
+	<-fetchStarted
+	go func() {
+		defer wg.Done()
+		var err error
+		waiter, err = s.DoResult(ctx, "t1", fn)
+		assert.NoError(t, err)
+	}()
+	wg.Wait()
+
+	assert.Equal(t, "result", leader.Value)
+	assert.Equal(t, stampede.SourceFetch, leader.Source)
+	assert.True(t, leader.Shared)
+	assert.Equal(t, "result", waiter.Value)
+	assert.Equal(t, stampede.SourceShared, waiter.Source)
+	assert.True(t, waiter.Shared)
+
+	time.Sleep(100 * time.Millisecond)
+	hit, err := s.DoResult(ctx, "t1", fn)
+	require.NoError(t, err)
+	assert.Equal(t, stampede.SourceCache, hit.Source)
+	assert.False(t, hit.Shared)
+	assert.GreaterOrEqual(t, hit.Age, 100*time.Millisecond)
+	assert.Greater(t, hit.TTL, 4*time.Second)
+	assert.LessOrEqual(t, hit.TTL, 5*time.Second-hit.Age)
+}
+
+func BenchmarkDo(b *testing.B) {
+	cases := []struct {
+		name    string
+		numKeys int
+		options []stampede.Option
+	}{
+		{name: "keys=1", numKeys: 1},
+		{name: "keys=100", numKeys: 100},
+		{name: "keys=10000", numKeys: 10000},
+		{name: "keys=100/local", numKeys: 100, options: []stampede.Option{stampede.WithLocalCache(time.Minute)}},
+		// the local cache is full, so every miss evicts an entry
+		{name: "keys=10000/local-full", numKeys: 10000, options: []stampede.Option{stampede.WithLocalCache(time.Minute), stampede.WithLocalCacheSize(1000)}},
+	}
+	for _, bc := range cases {
+		numKeys := bc.numKeys
+		b.Run(bc.name, func(b *testing.B) {
+			s := stampede.NewStampede[any](slog.Default(), newMockCacheBackend(), append([]stampede.Option{stampede.WithTTL(time.Minute)}, bc.options...)...)
+			fn := func() (any, *time.Duration, error) {
+				return "result", nil, nil
+			}
+			keys := make([]string, numKeys)
+			for i := range keys {
+				keys[i] = fmt.Sprintf("t%d", i)
+			}
+
+			var seq atomic.Int64
+			b.SetParallelism(8)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := int(seq.Add(1))
+				for pb.Next() {
+					s.Do(context.Background(), keys[i%numKeys], fn)
+					i++
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkDoSlowWrites measures the cache hits of hot keys, while other
+// keys keep missing and being written to a slow cache backend.
+func BenchmarkDoSlowWrites(b *testing.B) {
+	backend := &slowWriteBackend{Backend: newMockCacheBackend(), delay: 5 * time.Millisecond}
+	s := stampede.NewStampede[any](slog.Default(), backend, stampede.WithTTL(time.Minute))
+	fn := func() (any, *time.Duration, error) {
+		return "result", nil, nil
+	}
+	keys := make([]string, 100)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("hot%d", i)
+		s.Do(context.Background(), keys[i], fn)
+	}
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; ; n++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				s.Do(context.Background(), fmt.Sprintf("cold%d:%d", i, n), fn)
+			}
+		}()
+	}
+
+	var seq atomic.Int64
+	b.SetParallelism(8)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := int(seq.Add(1))
+		for pb.Next() {
+			s.Do(context.Background(), keys[i%len(keys)], fn)
+			i++
+		}
+	})
+	b.StopTimer()
+	close(stop)
+	wg.Wait()
+}
+
+// slowWriteBackend is a cache backend with slow writes.
+type slowWriteBackend struct {
+	cachestore.Backend
+	delay time.Duration
+}
+
+func (b *slowWriteBackend) SetEx(ctx context.Context, key string, value any, ttl time.Duration) error {
+	time.Sleep(b.delay)
+	return b.Backend.SetEx(ctx, key, value, ttl)
+}
+
 func newMockCacheBackend() cachestore.Backend {
 	return &mockCacheBackend[any]{
 		cache:  make(map[string]any),
@@ -109,7 +1701,45 @@ func newMockCacheBackend() cachestore.Backend {
 	}
 }
 
+// byteCacheBackend is an in-memory cache backend storing serialized values,
+// like the cache backends of external stores, ie. Redis.
+type byteCacheBackend struct {
+	*mockCacheBackend[any]
+	bytes *mockCacheBackend[[]byte]
+}
+
+var _ cachestore.ByteStoreGetter = &byteCacheBackend{}
+
+func newByteCacheBackend() *byteCacheBackend {
+	return &byteCacheBackend{
+		mockCacheBackend: newMockCacheBackend().(*mockCacheBackend[any]),
+		bytes: &mockCacheBackend[[]byte]{
+			cache:  make(map[string][]byte),
+			expiry: make(map[string]int64),
+		},
+	}
+}
+
+func (b *byteCacheBackend) ByteStore() cachestore.Store[[]byte] {
+	return b.bytes
+}
+
+func (b *byteCacheBackend) Exists(ctx context.Context, key string) (bool, error) {
+	return b.bytes.Exists(ctx, key)
+}
+
+func (b *byteCacheBackend) Delete(ctx context.Context, key string) error {
+	return b.bytes.Delete(ctx, key)
+}
+
+func (b *byteCacheBackend) DeletePrefix(ctx context.Context, keyPrefix string) error {
+	return b.bytes.DeletePrefix(ctx, keyPrefix)
+}
+
+// mockCacheBackend is an in-memory cache backend, which is safe for
+// concurrent use.
 type mockCacheBackend[V any] struct {
+	mu     sync.Mutex
 	cache  map[string]V
 	expiry map[string]int64
 }
@@ -125,22 +1755,30 @@ func (m *mockCacheBackend[V]) Options() cachestore.StoreOptions {
 }
 
 func (m *mockCacheBackend[V]) Exists(ctx context.Context, key string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	_, ok := m.cache[key]
 	return ok, nil
 }
 
 func (m *mockCacheBackend[V]) Set(ctx context.Context, key string, value V) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	m.cache[key] = value
 	return nil
 }
 
 func (m *mockCacheBackend[V]) SetEx(ctx context.Context, key string, value V, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	m.cache[key] = value
-	m.expiry[key] = time.Now().Unix() + int64(ttl.Seconds())
+	m.expiry[key] = time.Now().Add(ttl).UnixNano()
 	return nil
 }
 
 func (m *mockCacheBackend[V]) BatchSet(ctx context.Context, keys []string, values []V) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	for i, key := range keys {
 		m.cache[key] = values[i]
 	}
@@ -148,18 +1786,26 @@ func (m *mockCacheBackend[V]) BatchSet(ctx context.Context, keys []string, value
 }
 
 func (m *mockCacheBackend[V]) BatchSetEx(ctx context.Context, keys []string, values []V, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	for i, key := range keys {
 		m.cache[key] = values[i]
-		m.expiry[key] = time.Now().Unix() + int64(ttl.Seconds())
+		m.expiry[key] = time.Now().Add(ttl).UnixNano()
 	}
 	return nil
 }
 
 func (m *mockCacheBackend[V]) Get(ctx context.Context, key string) (V, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.get(key)
+}
+
+func (m *mockCacheBackend[V]) get(key string) (V, bool, error) {
 	v, ok := m.cache[key]
 	if ok {
 		expiry, ok := m.expiry[key]
-		if ok && expiry < time.Now().Unix() {
+		if ok && expiry < time.Now().UnixNano() {
 			delete(m.cache, key)
 			delete(m.expiry, key)
 			var v V
@@ -170,17 +1816,19 @@ func (m *mockCacheBackend[V]) Get(ctx context.Context, key string) (V, bool, err
 }
 
 func (m *mockCacheBackend[V]) BatchGet(ctx context.Context, keys []string) ([]V, []bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	values := make([]V, len(keys))
 	exists := make([]bool, len(keys))
 	var err error
 	for i, key := range keys {
-		values[i], exists[i], err = m.Get(ctx, key)
+		values[i], exists[i], err = m.get(key)
 		if err != nil {
 			return nil, nil, err
 		}
 		if exists[i] {
 			expiry, ok := m.expiry[key]
-			if ok && expiry < time.Now().Unix() {
+			if ok && expiry < time.Now().UnixNano() {
 				exists[i] = false
 				var v V
 				values[i] = v
@@ -191,12 +1839,16 @@ func (m *mockCacheBackend[V]) BatchGet(ctx context.Context, keys []string) ([]V,
 }
 
 func (m *mockCacheBackend[V]) Delete(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	delete(m.cache, key)
 	delete(m.expiry, key)
 	return nil
 }
 
 func (m *mockCacheBackend[V]) DeletePrefix(ctx context.Context, keyPrefix string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	for key := range m.cache {
 		if strings.HasPrefix(key, keyPrefix) {
 			delete(m.cache, key)
@@ -207,17 +1859,32 @@ func (m *mockCacheBackend[V]) DeletePrefix(ctx context.Context, keyPrefix string
 }
 
 func (m *mockCacheBackend[V]) ClearAll(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	m.cache = make(map[string]V)
 	m.expiry = make(map[string]int64)
 	return nil
 }
 
 func (m *mockCacheBackend[V]) GetOrSetWithLock(ctx context.Context, key string, getter func(context.Context, string) (V, error)) (V, error) {
-	var v V
-	return v, fmt.Errorf("not implemented")
+	return m.GetOrSetWithLockEx(ctx, key, getter, 0)
 }
 
 func (m *mockCacheBackend[V]) GetOrSetWithLockEx(ctx context.Context, key string, getter func(context.Context, string) (V, error), ttl time.Duration) (V, error) {
-	var v V
-	return v, fmt.Errorf("not implemented")
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if v, ok, _ := m.get(key); ok {
+		return v, nil
+	}
+	v, err := getter(ctx, key)
+	if err != nil {
+		return v, err
+	}
+	m.cache[key] = v
+	if ttl > 0 {
+		m.expiry[key] = time.Now().Add(ttl).UnixNano()
+	} else {
+		delete(m.expiry, key)
+	}
+	return v, nil
 }
@@ -0,0 +1,90 @@
+package stampede
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Stats is a snapshot of the counters of a Stampede instance.
+type Stats struct {
+	// Hits is the number of calls served a fresh value from the cache.
+	Hits uint64
+
+	// StaleHits is the number of calls served a stale value from the cache,
+	// see WithStaleWhileRevalidate and WithStaleIfError.
+	StaleHits uint64
+
+	// Misses is the number of calls which waited on a fetch, either their
+	// own or one shared with other callers.
+	Misses uint64
+
+	// SharedWaits is the number of calls served the value of another
+	// caller's in-flight fetch.
+	SharedWaits uint64
+
+	// Fetches is the number of keys fetched by the fetch function.
+	Fetches uint64
+
+	// FetchErrors is the number of keys for which the fetch function
+	// returned an error.
+	FetchErrors uint64
+
+	// FailedWrites is the number of failures to write a fetched value to
+	// the cache.
+	FailedWrites uint64
+
+	// DroppedWrites is the number of fetched values which were not written
+	// to the cache because the write-behind queue was full.
+	DroppedWrites uint64
+
+	// Errors is the number of failures to read from the cache.
+	Errors uint64
+}
+
+// stats is the Observer keeping the counters of a stampede instance.
+type stats struct {
+	hits          atomic.Uint64
+	staleHits     atomic.Uint64
+	misses        atomic.Uint64
+	sharedWaits   atomic.Uint64
+	fetches       atomic.Uint64
+	fetchErrors   atomic.Uint64
+	failedWrites  atomic.Uint64
+	droppedWrites atomic.Uint64
+	errors        atomic.Uint64
+}
+
+var _ Observer = &stats{}
+
+func (s *stats) Hit(key string)          { s.hits.Add(1) }
+func (s *stats) StaleHit(key string)     { s.staleHits.Add(1) }
+func (s *stats) Miss(key string)         { s.misses.Add(1) }
+func (s *stats) SharedWait(key string)   { s.sharedWaits.Add(1) }
+func (s *stats) DroppedWrite(key string) { s.droppedWrites.Add(1) }
+func (s *stats) FailedWrite(key string, err error) {
+	s.failedWrites.Add(1)
+}
+func (s *stats) Error(key string, err error) {
+	s.errors.Add(1)
+}
+
+func (s *stats) Fetch(key string, duration time.Duration, err error) {
+	s.fetches.Add(1)
+	if err != nil {
+		s.fetchErrors.Add(1)
+	}
+}
+
+func (s *stats) snapshot() Stats {
+	return Stats{
+		Hits:          s.hits.Load(),
+		StaleHits:     s.staleHits.Load(),
+		Misses:        s.misses.Load(),
+		SharedWaits:   s.sharedWaits.Load(),
+		Fetches:       s.fetches.Load(),
+		FetchErrors:   s.fetchErrors.Load(),
+		FailedWrites:  s.failedWrites.Load(),
+		DroppedWrites: s.droppedWrites.Load(),
+		Errors:        s.errors.Load(),
+	}
+}
@@ -0,0 +1,95 @@
+package stampede
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+)
+
+// tagIndex is the index of the keys cached with a tag. It's kept in the
+// cache store under the namespace, so every replica sharing the cache store
+// may invalidate the keys cached by the others, see InvalidateTag.
+type tagIndex struct {
+	// Keys holds the hard expiry of each tagged key, after which the key is
+	// pruned from the index.
+	Keys map[string]time.Time `json:"keys"`
+}
+
+// tagKey returns the key of the index of tag in the cache store.
+func (s *Stampede[V]) tagKey(tag string) string {
+	namespace := s.opts().Namespace
+	if namespace == "" {
+		namespace = DefaultNamespace
+	}
+	return fmt.Sprintf("%s#tag:%s", namespace, tag)
+}
+
+// indexTags adds key, which expires from the cache store at expiresAt, to
+// the index of each of tags, ahead of caching its value, so a value in the
+// cache store is always found by InvalidateTag. It may wait on the lease of
+// a tag held by another replica, so it must not be called under the lock of
+// the key. Errors are logged, and the value is still cached.
+func (s *Stampede[V]) indexTags(ctx context.Context, key string, tags []string, expiresAt time.Time) {
+	if s.tags == nil {
+		return
+	}
+	tags = slices.Compact(slices.Sorted(slices.Values(tags)))
+	for _, tag := range tags {
+		err := s.updateTagIndex(ctx, tag, func(keys map[string]time.Time) {
+			keys[key] = expiresAt
+		})
+		if err != nil {
+			s.logger.Error("stampede: fail to index cache tag", "tag", tag, "err", err)
+			s.observe().FailedWrite(key, err)
+		}
+	}
+}
+
+// updateTagIndex applies update to the index of tag, and prunes the expired
+// keys from it. The index is updated under the lock of the tag, and under
+// its lease, so the concurrent updates of several replicas aren't lost. The
+// lease is taken with the Locker of the stampede instance, or else in the
+// cache store, see StoreLocker.
+func (s *Stampede[V]) updateTagIndex(ctx context.Context, tag string, update func(keys map[string]time.Time)) error {
+	tagKey := s.tagKey(tag)
+	mu := s.tagLocks.lock(tagKey)
+	defer mu.Unlock()
+	locker := s.opts().Locker
+	if locker == nil {
+		locker = s.tagLocker
+	}
+	release, err := s.takeLease(ctx, locker, tagKey, nil)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	idx, _, err := s.tags.Get(ctx, tagKey)
+	if err != nil {
+		return err
+	}
+	// the stored index may be shared by an in-memory cache store, so it's
+	// updated on a copy
+	idx.Keys = maps.Clone(idx.Keys)
+	if idx.Keys == nil {
+		idx.Keys = make(map[string]time.Time)
+	}
+	update(idx.Keys)
+
+	// the index expires along with the last of its keys
+	now := time.Now()
+	var expiresAt time.Time
+	for key, t := range idx.Keys {
+		if now.After(t) {
+			delete(idx.Keys, key)
+		} else if t.After(expiresAt) {
+			expiresAt = t
+		}
+	}
+	if len(idx.Keys) == 0 {
+		return s.tags.Delete(ctx, tagKey)
+	}
+	return s.tags.SetEx(ctx, tagKey, idx, expiresAt.Sub(now))
+}
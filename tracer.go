@@ -0,0 +1,67 @@
+package stampede
+
+import (
+	"context"
+	"sync"
+)
+
+// Tracer traces the phases of the calls of a stampede instance and of the
+// HTTP middleware, ie. to record spans. See the otel subpackage for an
+// OpenTelemetry implementation. Each method is called as its phase starts,
+// and returns the context of the phase along with a func which is called as
+// the phase ends. The key passed to the tracer is the namespaced cache key.
+type Tracer interface {
+	// Lookup traces the read of key from the cache, which ends with whether
+	// the key was found.
+	Lookup(ctx context.Context, key string) (context.Context, func(hit bool, err error))
+
+	// Wait traces a caller waiting on the flight of key. It ends with
+	// whether the caller was the leader whose fetch was run by the flight,
+	// and with the context of that fetch, as returned by Fetch. Both are
+	// unset when the caller has gone away before the fetch completed.
+	Wait(ctx context.Context, key string) (context.Context, func(leader bool, fetch context.Context, err error))
+
+	// Fetch traces the fetch of key run by a flight, which ends with the
+	// number of callers waiting on it.
+	Fetch(ctx context.Context, key string) (context.Context, func(waiters int, err error))
+}
+
+// noopTracer is the Tracer of stampede instances without one.
+type noopTracer struct{}
+
+func (noopTracer) Lookup(ctx context.Context, key string) (context.Context, func(bool, error)) {
+	return ctx, func(bool, error) {}
+}
+
+func (noopTracer) Wait(ctx context.Context, key string) (context.Context, func(bool, context.Context, error)) {
+	return ctx, func(bool, context.Context, error) {}
+}
+
+func (noopTracer) Fetch(ctx context.Context, key string) (context.Context, func(int, error)) {
+	return ctx, func(int, error) {}
+}
+
+// waiterCount counts the callers waiting on the flight of each key, for the
+// Tracer. It's only kept when the stampede instance has a Tracer.
+type waiterCount struct {
+	mu sync.Mutex
+	m  map[string]int
+}
+
+func (c *waiterCount) add(key string, n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.m == nil {
+		c.m = make(map[string]int)
+	}
+	c.m[key] += n
+	if c.m[key] <= 0 {
+		delete(c.m, key)
+	}
+}
+
+func (c *waiterCount) get(key string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.m[key]
+}
@@ -0,0 +1,208 @@
+package stampede
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// writeBehindWorkers is the number of workers of the write-behind queue.
+const writeBehindWorkers = 4
+
+// cacheWrite is the write of a fetched value to the cache, which is fresh for
+// entryTTL, and kept in the cache for ttl, including the stale window past
+// its soft expiry.
+type cacheWrite[V any] struct {
+	ctx      context.Context
+	key      string
+	entry    entry[V]
+	entryTTL time.Duration
+	ttl      time.Duration
+	tags     []string
+
+	// id is the id of a pending write-behind.
+	id uint64
+
+	// release releases the lease of the key once written, if any, see
+	// WithLocker.
+	release func()
+}
+
+// done releases the lease held by the write, once written or dropped.
+func (w cacheWrite[V]) done() {
+	if w.release != nil {
+		w.release()
+	}
+}
+
+// writeQueue is the write-behind queue of a stampede instance, which is
+// started on the first write.
+type writeQueue[V any] struct {
+	mu      sync.Mutex
+	ch      chan cacheWrite[V]
+	closed  bool
+	workers sync.WaitGroup
+
+	// pending holds the pending write of each key, whose value is served
+	// in-process until it's written, so the key isn't fetched again in the
+	// meantime. A write of a key which was forgotten or invalidated in the
+	// meantime, or superseded by a newer write, is dropped.
+	pending map[string]cacheWrite[V]
+	seq     uint64
+
+	// writing orders the writes of each key, which are made without the
+	// lock of the key, see writeBehind.
+	writing keyLocks
+}
+
+// enqueueWrite queues the write of a fetched value to the cache, or drops it
+// when the queue is full. It must be called with the lock of the key held.
+func (s *Stampede[V]) enqueueWrite(w cacheWrite[V]) {
+	q := &s.writes
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		w.done()
+		s.observe().DroppedWrite(w.key)
+		return
+	}
+	if q.ch == nil {
+		q.ch = make(chan cacheWrite[V], s.opts().WriteBehind)
+		q.pending = make(map[string]cacheWrite[V])
+		q.workers.Add(writeBehindWorkers)
+		for i := 0; i < writeBehindWorkers; i++ {
+			go func() {
+				defer q.workers.Done()
+				for w := range q.ch {
+					s.writeBehind(w)
+				}
+			}()
+		}
+	}
+
+	q.seq++
+	w.id = q.seq
+	select {
+	case q.ch <- w:
+		q.pending[w.key] = w
+	default:
+		delete(q.pending, w.key)
+		w.done()
+		s.observe().DroppedWrite(w.key)
+	}
+}
+
+// writeBehind writes a queued value to the cache, unless its key was
+// invalidated or written again since. The value is served from the pending
+// writes until the write completes.
+//
+// The value is written without the lock of the key, so a slow cache store
+// doesn't hold up the fetches of the other keys sharing its stripe. A key
+// invalidated while its value was being written is removed again once the
+// write completes.
+func (s *Stampede[V]) writeBehind(w cacheWrite[V]) {
+	defer w.done()
+	wmu := s.writes.writing.lock(w.key)
+	defer wmu.Unlock()
+	if !s.writes.isPending(w) {
+		return
+	}
+	if len(w.tags) > 0 {
+		s.indexTags(w.ctx, w.key, w.tags, time.Now().Add(w.ttl))
+	}
+	s.writeCache(w)
+
+	mu := s.keyLocks.lock(w.key)
+	defer mu.Unlock()
+	if s.writes.isPending(w) {
+		s.writes.done(w)
+		return
+	}
+	if _, ok := s.writes.get(w.key); ok {
+		// superseded by a newer write, which is made next
+		return
+	}
+	if err := s.cache.Delete(context.WithoutCancel(w.ctx), w.key); err != nil {
+		s.logger.Error("stampede: fail to delete invalidated cache value", "err", err)
+		s.observe().Error(w.key, err)
+	}
+}
+
+// get returns the value of the pending write of key, if any.
+func (q *writeQueue[V]) get(key string) (entry[V], bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	w, ok := q.pending[key]
+	return w.entry, ok
+}
+
+// isPending reports whether w is still the pending write of its key.
+func (q *writeQueue[V]) isPending(w cacheWrite[V]) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	p, ok := q.pending[w.key]
+	return ok && p.id == w.id
+}
+
+// done unregisters the pending write w, once written.
+func (q *writeQueue[V]) done(w cacheWrite[V]) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if p, ok := q.pending[w.key]; ok && p.id == w.id {
+		delete(q.pending, w.key)
+	}
+}
+
+// forget drops the pending write of key, if any.
+func (q *writeQueue[V]) forget(key string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.pending, key)
+}
+
+// forgetPrefix drops the pending writes of all keys with the given prefix.
+func (q *writeQueue[V]) forgetPrefix(prefix string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for k := range q.pending {
+		if strings.HasPrefix(k, prefix) {
+			delete(q.pending, k)
+		}
+	}
+}
+
+// tagged returns the keys whose pending write has tag.
+func (q *writeQueue[V]) tagged(tag string) []string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var keys []string
+	for k, w := range q.pending {
+		if slices.Contains(w.tags, tag) {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// closeWrites closes the write-behind queue, and returns a channel which is
+// closed once the queued writes are flushed.
+func (s *Stampede[V]) closeWrites() <-chan struct{} {
+	q := &s.writes
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		if q.ch != nil {
+			close(q.ch)
+		}
+	}
+	q.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		q.workers.Wait()
+		close(done)
+	}()
+	return done
+}